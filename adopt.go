@@ -0,0 +1,116 @@
+package gardensystemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+)
+
+// adoptContainers takes back the containers left running by a previous run
+// of the server, e.g. one that stopped with DetachOnStop set. A container is
+// adopted if its depot dir has metadata and the runtime reports it running;
+// anything else is left for cleanupOrphans.
+func (backend *Backend) adoptContainers() {
+	log := backend.logger.Session("adopt-containers")
+
+	log.Info("starting")
+	defer log.Info("done")
+
+	ids, err := backend.runtime.List()
+	if err != nil {
+		log.Error("failed-to-list-containers", err)
+		return
+	}
+
+	known := map[string]bool{}
+	for _, id := range ids {
+		known[id] = true
+	}
+
+	entries, err := ioutil.ReadDir(backend.containersDir)
+	if err != nil {
+		log.Error("failed-to-list-depot", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "container-") {
+			continue
+		}
+
+		id := strings.TrimPrefix(entry.Name(), "container-")
+		dir := filepath.Join(backend.containersDir, entry.Name())
+
+		if !known[id] {
+			continue
+		}
+
+		metadata, err := readMetadata(dir)
+		if os.IsNotExist(err) {
+			log.Info("skipping-unfinished-container", lager.Data{"id": id})
+			continue
+		}
+
+		if err != nil {
+			log.Error("failed-to-read-metadata", err, lager.Data{"id": id})
+			continue
+		}
+
+		status, err := backend.runtime.Status(id)
+		if err != nil {
+			log.Error("failed-to-get-status", err, lager.Data{"id": id})
+			continue
+		}
+
+		if !status.Running {
+			log.Info("skipping-stopped-container", lager.Data{"id": id, "reason": status.Reason})
+			continue
+		}
+
+		backend.adopt(log, id, dir, metadata)
+	}
+}
+
+func (backend *Backend) adopt(log lager.Logger, id string, dir string, metadata containerMetadata) {
+	container := newContainer(
+		backend.logger.Session("container", lager.Data{"handle": metadata.Handle, "id": id}),
+		backend.metrics,
+		garden.ContainerSpec{
+			Handle:     metadata.Handle,
+			Properties: metadata.Properties,
+			Env:        metadata.Env,
+			GraceTime:  metadata.GraceTime,
+		},
+		dir,
+		id,
+		backend.runtime,
+		backend.wshdCodec,
+	)
+
+	// newContainer would default it if zero
+	container.graceTime = metadata.GraceTime
+
+	container.events = metadata.Events
+
+	backend.containersL.Lock()
+	_, exists := backend.containers[metadata.Handle]
+	if !exists {
+		backend.containers[metadata.Handle] = container
+	}
+	backend.containersL.Unlock()
+
+	if exists {
+		log.Error("failed-to-adopt-container", DuplicateHandleError{Handle: metadata.Handle}, lager.Data{"id": id})
+		return
+	}
+
+	container.transition("adopt", containerActive, containerCreating)
+
+	go backend.watch(container)
+
+	log.Info("adopted-container", lager.Data{"handle": metadata.Handle, "id": id})
+}
@@ -3,39 +3,74 @@ package gardensystemd
 import (
 	"bytes"
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net/url"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
 )
 
 type Backend struct {
+	// if set, orphans found on start are only logged, not removed
+	CleanupDryRun bool
+
+	// if set, Stop leaves containers running for the next start to adopt,
+	// rather than destroying them
+	DetachOnStop bool
+
+	logger  lager.Logger
+	metrics *Metrics
+
+	runtime Runtime
+
 	containersDir string
 	skeletonDir   string
 
+	defaultLimits garden.ResourceLimits
+
+	wshdCodec ginit.Codec
+
 	containers  map[string]*container
 	containersL sync.RWMutex
 
+	events *eventHub
+
+	// draining is closed once Drain is called, and drained once it finishes
+	draining  chan struct{}
+	drained   chan struct{}
+	drainOnce sync.Once
+
 	containerNum uint64
 }
 
-func NewBackend(containersDir string, skeletonDir string) *Backend {
+func NewBackend(logger lager.Logger, metrics *Metrics, runtime Runtime, containersDir string, skeletonDir string, defaultLimits garden.ResourceLimits, wshdCodec ginit.Codec) *Backend {
 	return &Backend{
+		logger:  logger,
+		metrics: metrics,
+
+		runtime: runtime,
+
 		containersDir: containersDir,
 		skeletonDir:   skeletonDir,
 
+		defaultLimits: defaultLimits,
+
+		wshdCodec: wshdCodec,
+
 		containers: make(map[string]*container),
 
+		events: newEventHub(),
+
+		draining: make(chan struct{}),
+		drained:  make(chan struct{}),
+
 		containerNum: uint64(time.Now().UnixNano()),
 	}
 }
@@ -46,14 +81,25 @@ func (backend *Backend) Start() error {
 		return err
 	}
 
-	return run(exec.Command(
-		"systemctl",
-		"link",
-		filepath.Join(backend.skeletonDir, "garden-container@.service"),
-	))
+	err = backend.runtime.Setup()
+	if err != nil {
+		return err
+	}
+
+	// adopted containers aren't orphans
+	backend.adoptContainers()
+
+	backend.cleanupOrphans()
+
+	return nil
 }
 
 func (backend *Backend) Stop() {
+	if backend.DetachOnStop {
+		backend.detach()
+		return
+	}
+
 	containers, _ := backend.Containers(nil)
 
 	for _, container := range containers {
@@ -61,6 +107,34 @@ func (backend *Backend) Stop() {
 	}
 }
 
+// detach lets go of every container without stopping it, leaving its unit
+// and depot dir as they are.
+func (backend *Backend) detach() {
+	log := backend.logger.Session("detach")
+
+	backend.containersL.RLock()
+	containers := make([]*container, 0, len(backend.containers))
+	for _, container := range backend.containers {
+		containers = append(containers, container)
+	}
+	backend.containersL.RUnlock()
+
+	for _, container := range containers {
+		if container.currentState() == containerCreating {
+			// not watched yet; if it finishes, it's adopted next time
+			continue
+		}
+
+		container.stopWatcher()
+		container.wshd.Close()
+
+		log.Info("detached-container", lager.Data{
+			"handle": container.handle,
+			"id":     container.id,
+		})
+	}
+}
+
 func (backend *Backend) GraceTime(c garden.Container) time.Duration {
 	return c.(*container).currentGraceTime()
 }
@@ -70,14 +144,22 @@ func (backend *Backend) Ping() error {
 }
 
 func (backend *Backend) Capacity() (garden.Capacity, error) {
-	println("NOT IMPLEMENTED: Capacity")
+	backend.logger.Debug("capacity-not-implemented")
 	return garden.Capacity{}, nil
 }
 
 var ErrNoRootFS = errors.New("no rootfs path specified")
 
 func (backend *Backend) Create(spec garden.ContainerSpec) (garden.Container, error) {
+	started := time.Now()
+
+	if backend.isDraining() {
+		backend.metrics.observe("create", started, causedError{"draining", ErrDraining})
+		return nil, ErrDraining
+	}
+
 	if spec.RootFSPath == "" {
+		backend.metrics.observe("create", started, causedError{"validate-rootfs", ErrNoRootFS})
 		return nil, ErrNoRootFS
 	}
 
@@ -87,159 +169,131 @@ func (backend *Backend) Create(spec garden.ContainerSpec) (garden.Container, err
 		spec.Handle = id
 	}
 
-	dir := filepath.Join(backend.containersDir, "container-"+id)
+	log := backend.logger.Session("create", lager.Data{
+		"handle": spec.Handle,
+		"id":     id,
+	})
 
-	container := newContainer(spec, dir, id)
+	log.Info("starting", lager.Data{"rootfs": spec.RootFSPath})
 
-	err := os.MkdirAll(dir, 0755)
-	if err != nil {
-		return nil, err
-	}
-
-	nspawnFlags := []string{}
+	container := newContainer(
+		backend.logger.Session("container", lager.Data{"handle": spec.Handle, "id": id}),
+		backend.metrics,
+		spec,
+		filepath.Join(backend.containersDir, "container-"+id),
+		id,
+		backend.runtime,
+		backend.wshdCodec,
+	)
 
-	for _, mount := range spec.BindMounts {
-		switch mount.Mode {
-		case garden.BindMountModeRO:
-			nspawnFlags = append(nspawnFlags, "--bind-ro", mount.SrcPath+":"+mount.DstPath)
-		case garden.BindMountModeRW:
-			nspawnFlags = append(nspawnFlags, "--bind", mount.SrcPath+":"+mount.DstPath)
-		}
+	// reserve the handle, so that it can't be created twice at once
+	backend.containersL.Lock()
+	_, exists := backend.containers[spec.Handle]
+	if !exists {
+		backend.containers[spec.Handle] = container
 	}
+	backend.containersL.Unlock()
 
-	rootfsURL, err := url.Parse(spec.RootFSPath)
-	if err != nil {
-		return nil, fmt.Errorf("invalid rootfs URI: %s", spec.RootFSPath)
+	if exists {
+		err := DuplicateHandleError{Handle: spec.Handle}
+		log.Error("failed", err)
+		backend.metrics.observe("create", started, err)
+		return nil, err
 	}
 
-	if rootfsURL.Scheme != "raw" {
-		return nil, fmt.Errorf("unsupported rootfs URI (only raw:// supported): %s", spec.RootFSPath)
-	}
+	err := backend.create(log, container, spec)
 
-	start := fmt.Sprintf(
-		`#!/bin/sh
-
-exec /usr/bin/systemd-nspawn \
-	--capability all \
-	--machine %[1]s \
-	--directory '%[2]s' \
-	--ephemeral \
-	--quiet \
-	--keep-unit \
-	--bind /var/lib/garden/container-%[1]s/tmp:/tmp \
-	--bind /var/lib/garden/container-%[1]s/run:/tmp/garden-init \
-	--bind /var/lib/garden/container-%[1]s/bin/wshd:/sbin/wshd \
-	%[3]s \
-	-- /sbin/wshd --run /tmp/garden-init`,
-		id,
-		rootfsURL.Path,
-		strings.Join(nspawnFlags, " "),
-	)
+	backend.metrics.observe("create", started, err)
 
-	err = ioutil.WriteFile(filepath.Join(dir, "start"), []byte(start), 0755)
 	if err != nil {
+		backend.containersL.Lock()
+		delete(backend.containers, spec.Handle)
+		backend.containersL.Unlock()
+
+		log.Error("failed", err, lager.Data{"duration": time.Since(started).String()})
 		return nil, err
 	}
 
-	runDir := filepath.Join(dir, "run")
-	binDir := filepath.Join(dir, "bin")
-	tmpDir := filepath.Join(dir, "tmp")
+	container.transition("create", containerActive, containerCreating)
 
-	if err := os.MkdirAll(runDir, 0755); err != nil {
-		return nil, err
-	}
+	go backend.watch(container)
 
-	if err := os.MkdirAll(binDir, 0755); err != nil {
-		return nil, err
-	}
+	log.Info("created", lager.Data{"duration": time.Since(started).String()})
 
-	if err := os.MkdirAll(tmpDir, 0777); err != nil {
-		return nil, err
-	}
+	return container, nil
+}
 
-	err = run(exec.Command("cp", "-a", filepath.Join(backend.skeletonDir, "bin", "wshd"), filepath.Join(binDir, "wshd")))
-	if err != nil {
-		return nil, err
-	}
+// Destroy stops the container and removes its depot dir. Destroying a
+// container that is already being destroyed waits for that to finish and
+// returns its result; once it is gone, it is no longer found.
+func (backend *Backend) Destroy(handle string) error {
+	started := time.Now()
 
-	// clear out any existing resolv.conf
-	err = os.RemoveAll(filepath.Join(rootfsURL.Path, "etc", "resolv.conf"))
-	if err != nil {
-		return nil, err
-	}
+	backend.containersL.RLock()
+	container, found := backend.containers[handle]
+	backend.containersL.RUnlock()
 
-	// create sbin/wshd in rootfs to fool nspawn validation
-	sbinDir := filepath.Join(rootfsURL.Path, "sbin")
-	err = os.MkdirAll(sbinDir, 0755)
-	if err != nil {
-		return nil, err
+	if !found {
+		err := garden.ContainerNotFoundError{Handle: handle}
+		backend.metrics.observe("destroy", started, err)
+		return err
 	}
 
-	wshdIsh, err := os.Create(filepath.Join(sbinDir, "wshd"))
+	log := backend.logger.Session("destroy", lager.Data{
+		"handle": handle,
+		"id":     container.id,
+	})
+
+	destroying, err := container.beginDestroy()
 	if err != nil {
-		return nil, err
+		log.Error("failed", err)
+		backend.metrics.observe("destroy", started, err)
+		return err
 	}
 
-	wshdIsh.Close()
-
-	err = run(exec.Command("systemctl", "start", "garden-container@"+id))
-	if err != nil {
-		return nil, err
+	if destroying != nil {
+		log.Info("waiting-for-destroy-in-progress")
+		<-destroying
+		return container.destroyResult()
 	}
 
-	created := false
+	log.Info("starting")
 
-	defer func() {
-		if !created {
-			if err := run(exec.Command("systemctl", "stop", "garden-container@"+id)); err != nil {
-				log.Println("failed to cleanup container:", err)
-			}
-		}
-	}()
+	err = backend.destroy(log, container)
 
-	for i := 0; i < 10; i++ {
-		err = run(exec.Command("machinectl", "status", id))
-		if err == nil {
-			break
-		}
+	container.finishDestroy(err)
 
-		time.Sleep(time.Second)
-	}
+	backend.metrics.observe("destroy", started, err)
 
 	if err != nil {
-		return nil, fmt.Errorf("container did not come up")
+		return err
 	}
 
-	backend.containersL.Lock()
-	backend.containers[spec.Handle] = container
-	backend.containersL.Unlock()
-
-	created = true
+	log.Info("destroyed", lager.Data{"duration": time.Since(started).String()})
 
-	return container, nil
+	return nil
 }
 
-func (backend *Backend) Destroy(handle string) error {
-	backend.containersL.RLock()
-	container, found := backend.containers[handle]
-	backend.containersL.RUnlock()
+func (backend *Backend) destroy(log lager.Logger, container *container) error {
+	// so that stopping it isn't reported as unexpected
+	container.stopWatcher()
 
-	if !found {
-		return garden.ContainerNotFoundError{Handle: handle}
-	}
+	container.wshd.Close()
 
-	err := run(exec.Command("systemctl", "stop", "garden-container@"+container.id))
+	err := backend.runtime.Stop(container.id)
 	if err != nil {
-		return err
+		log.Error("failed-to-stop-container", err)
+		return causedError{"runtime", err}
 	}
 
 	err = os.RemoveAll(container.dir)
 	if err != nil {
-		return err
+		log.Error("failed-to-remove-container-dir", err, lager.Data{"dir": container.dir})
+		return causedError{"depot", err}
 	}
 
 	backend.containersL.Lock()
-	delete(backend.containers, handle)
+	delete(backend.containers, container.handle)
 	backend.containersL.Unlock()
 
 	return nil
@@ -251,6 +305,10 @@ func (backend *Backend) Containers(filter garden.Properties) ([]garden.Container
 	backend.containersL.RLock()
 
 	for _, container := range backend.containers {
+		if container.currentState() == containerCreating {
+			continue
+		}
+
 		if containerHasProperties(container, filter) {
 			matchingContainers = append(matchingContainers, container)
 		}
@@ -266,13 +324,28 @@ func (backend *Backend) Lookup(handle string) (garden.Container, error) {
 	container, found := backend.containers[handle]
 	backend.containersL.RUnlock()
 
-	if !found {
+	// not until it has been created
+	if !found || container.currentState() == containerCreating {
 		return nil, garden.ContainerNotFoundError{Handle: handle}
 	}
 
 	return container, nil
 }
 
+// ProcessLog returns the persisted output of a process in the given
+// container, which remains available after the process has exited.
+func (backend *Backend) ProcessLog(handle string, processID string, stream ProcessLogStream) (io.ReadCloser, error) {
+	backend.containersL.RLock()
+	container, found := backend.containers[handle]
+	backend.containersL.RUnlock()
+
+	if !found {
+		return nil, garden.ContainerNotFoundError{Handle: handle}
+	}
+
+	return container.ProcessLog(processID, stream)
+}
+
 func (backend *Backend) BulkInfo(handles []string) (map[string]garden.ContainerInfoEntry, error) {
 	return map[string]garden.ContainerInfoEntry{}, nil
 }
@@ -315,16 +388,30 @@ func containerHasProperties(container *container, properties garden.Properties)
 	return true
 }
 
-func run(cmd *exec.Cmd) error {
+func run(log lager.Logger, cmd *exec.Cmd) error {
 	outBuf := new(bytes.Buffer)
 	errBuf := new(bytes.Buffer)
 
 	cmd.Stdout = outBuf
 	cmd.Stderr = errBuf
-	if err := cmd.Run(); err != nil {
-		log.Printf("command failed: %v\n\nstdout: %s\n\nstderr: %s\n", cmd.Args, outBuf.String(), errBuf.String())
+
+	started := time.Now()
+
+	err := cmd.Run()
+
+	data := lager.Data{
+		"argv":     cmd.Args,
+		"stdout":   outBuf.String(),
+		"stderr":   errBuf.String(),
+		"duration": time.Since(started).String(),
+	}
+
+	if err != nil {
+		log.Error("command-failed", err, data)
 		return err
 	}
 
+	log.Debug("command-succeeded", data)
+
 	return nil
 }
@@ -0,0 +1,390 @@
+package gardensystemd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+	"github.com/vito/garden-systemd/systemd"
+)
+
+// testBackend is a backend running containers through nspawn on a fake
+// systemd, with its depot, skeleton and a rootfs in a temporary dir.
+type testBackend struct {
+	*Backend
+
+	manager *systemd.FakeManager
+
+	depotDir  string
+	rootfsDir string
+
+	tmpDir string
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	tmpDir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	skeletonDir := filepath.Join(tmpDir, "skeleton")
+	rootfsDir := filepath.Join(tmpDir, "rootfs")
+
+	for _, dir := range []string{depotDir, filepath.Join(skeletonDir, "bin"), filepath.Join(rootfsDir, "etc")} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(skeletonDir, "bin", "wshd"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := lager.NewLogger("test")
+
+	manager := systemd.NewFakeManager()
+
+	backend := NewBackend(
+		logger,
+		NewMetrics(),
+		NewNspawnRuntime(logger, manager, skeletonDir),
+		depotDir,
+		skeletonDir,
+		garden.ResourceLimits{},
+		ginit.GobCodec,
+	)
+
+	return &testBackend{
+		Backend: backend,
+
+		manager: manager,
+
+		depotDir:  depotDir,
+		rootfsDir: rootfsDir,
+
+		tmpDir: tmpDir,
+	}
+}
+
+func (backend *testBackend) cleanup() {
+	backend.Stop()
+	os.RemoveAll(backend.tmpDir)
+}
+
+func (backend *testBackend) spec(handle string) garden.ContainerSpec {
+	return garden.ContainerSpec{
+		Handle:     handle,
+		RootFSPath: "raw://" + backend.rootfsDir,
+	}
+}
+
+func (backend *testBackend) depotEntries(t *testing.T) []string {
+	entries, err := ioutil.ReadDir(backend.depotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+// runningContainer sets up a container as a previous run of the server
+// would have left it: running, with its depot dir and metadata.
+func (backend *testBackend) runningContainer(t *testing.T, id string, metadata containerMetadata) {
+	dir := filepath.Join(backend.depotDir, "container-"+id)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeMetadata(dir, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.manager.StartUnit(containerUnit(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateStartsTheContainerUnit(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	err := backend.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := backend.Create(backend.spec("some-handle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := created.(*container).id
+
+	status, err := backend.manager.UnitStatus(containerUnit(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.ActiveState != "active" {
+		t.Errorf("expected the unit to be active, got %q", status.ActiveState)
+	}
+
+	_, err = os.Stat(filepath.Join(backend.depotDir, "container-"+id, "metadata.json"))
+	if err != nil {
+		t.Errorf("expected metadata to be written: %s", err)
+	}
+
+	_, err = backend.Lookup("some-handle")
+	if err != nil {
+		t.Errorf("expected the container to be found: %s", err)
+	}
+}
+
+func TestCreateRollsBackWhenTheContainerFailsToStart(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	resolvConf := filepath.Join(backend.rootfsDir, "etc", "resolv.conf")
+
+	err := ioutil.WriteFile(resolvConf, []byte("nameserver 1.2.3.4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startErr := errors.New("unit failed")
+	backend.manager.StartUnitStub = func(string) error {
+		return startErr
+	}
+
+	_, err = backend.Create(backend.spec("some-handle"))
+
+	createErr, ok := err.(CreateError)
+	if !ok {
+		t.Fatalf("expected a CreateError, got %#v", err)
+	}
+
+	if createErr.Step != "start-container" {
+		t.Errorf("expected start-container to fail, got %s", createErr.Step)
+	}
+
+	if entries := backend.depotEntries(t); len(entries) != 0 {
+		t.Errorf("expected the depot dir to be removed, found %v", entries)
+	}
+
+	content, err := ioutil.ReadFile(resolvConf)
+	if err != nil || string(content) != "nameserver 1.2.3.4\n" {
+		t.Errorf("expected resolv.conf to be restored, got %q (%v)", content, err)
+	}
+
+	_, err = os.Stat(filepath.Join(backend.rootfsDir, "sbin"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the wshd mount point to be removed: %v", err)
+	}
+
+	units, err := backend.manager.ListUnits(containerUnit("*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(units) != 0 {
+		t.Errorf("expected the unit to be stopped, found %v", units)
+	}
+
+	_, err = backend.Lookup("some-handle")
+	if _, ok := err.(garden.ContainerNotFoundError); !ok {
+		t.Errorf("expected the handle to be released, got %v", err)
+	}
+
+	// the handle can be used again
+	backend.manager.StartUnitStub = nil
+
+	_, err = backend.Create(backend.spec("some-handle"))
+	if err != nil {
+		t.Errorf("expected to be able to create the handle again: %s", err)
+	}
+}
+
+func TestDestroyStopsTheContainerAndRemovesItsDepotDir(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	created, err := backend.Create(backend.spec("some-handle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := created.(*container).id
+
+	err = backend.Destroy("some-handle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = backend.manager.UnitStatus(containerUnit(id))
+	if _, ok := err.(systemd.UnitNotFoundError); !ok {
+		t.Errorf("expected the unit to be stopped, got %v", err)
+	}
+
+	if entries := backend.depotEntries(t); len(entries) != 0 {
+		t.Errorf("expected the depot dir to be removed, found %v", entries)
+	}
+
+	_, err = backend.Lookup("some-handle")
+	if _, ok := err.(garden.ContainerNotFoundError); !ok {
+		t.Errorf("expected the container to be gone, got %v", err)
+	}
+
+	err = backend.Destroy("some-handle")
+	if _, ok := err.(garden.ContainerNotFoundError); !ok {
+		t.Errorf("expected destroying again to fail with not found, got %v", err)
+	}
+}
+
+func TestStartAdoptsRunningContainers(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	backend.runningContainer(t, "some-id", containerMetadata{
+		Handle:     "some-handle",
+		Properties: garden.Properties{"some": "property"},
+	})
+
+	err := backend.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := backend.Lookup("some-handle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := container.Property("some")
+	if err != nil || value != "property" {
+		t.Errorf("expected properties to be restored, got %q (%v)", value, err)
+	}
+
+	status, err := backend.manager.UnitStatus(containerUnit("some-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.ActiveState != "active" {
+		t.Errorf("expected the adopted container to be left running, got %q", status.ActiveState)
+	}
+
+	_, err = os.Stat(filepath.Join(backend.depotDir, "container-some-id"))
+	if err != nil {
+		t.Errorf("expected the adopted container's depot dir to be kept: %s", err)
+	}
+}
+
+func TestStartCleansUpOrphans(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	// running, but its Create never finished
+	err := os.MkdirAll(filepath.Join(backend.depotDir, "container-unfinished"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.manager.StartUnit(containerUnit("unfinished"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// running, with no depot dir at all
+	err = backend.manager.StartUnit(containerUnit("dirless"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// created, but no longer running
+	dir := filepath.Join(backend.depotDir, "container-stopped")
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeMetadata(dir, containerMetadata{Handle: "stopped-handle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	units, err := backend.manager.ListUnits(containerUnit("*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(units) != 0 {
+		t.Errorf("expected orphaned units to be stopped, found %v", units)
+	}
+
+	if entries := backend.depotEntries(t); len(entries) != 0 {
+		t.Errorf("expected orphaned depot dirs to be removed, found %v", entries)
+	}
+
+	containers, err := backend.Containers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(containers) != 0 {
+		t.Errorf("expected no containers to be adopted, found %d", len(containers))
+	}
+}
+
+func TestStartOnlyLogsOrphansInDryRun(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.cleanup()
+
+	backend.CleanupDryRun = true
+
+	err := os.MkdirAll(filepath.Join(backend.depotDir, "container-unfinished"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.manager.StartUnit(containerUnit("unfinished"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = backend.manager.UnitStatus(containerUnit("unfinished"))
+	if err != nil {
+		t.Errorf("expected the orphaned unit to be left running: %s", err)
+	}
+
+	if entries := backend.depotEntries(t); len(entries) != 1 {
+		t.Errorf("expected the orphaned depot dir to be left, found %v", entries)
+	}
+}
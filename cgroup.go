@@ -0,0 +1,210 @@
+package gardensystemd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+type cgroupStats struct {
+	MemoryBytes uint64
+	CPUTime     time.Duration
+	Pids        uint64
+}
+
+// readCgroupStats reads the resource usage of the cgroup that the given
+// process is in, under either the unified (v2) or legacy (v1) hierarchy.
+// It reports false if the process shares our own cgroup, in which case the
+// usage wouldn't be the container's alone.
+func readCgroupStats(pid int) (cgroupStats, bool, error) {
+	cgroups, err := procCgroups(strconv.Itoa(pid))
+	if err != nil {
+		return cgroupStats{}, false, err
+	}
+
+	ours, err := procCgroups("self")
+	if err != nil {
+		return cgroupStats{}, false, err
+	}
+
+	_, err = os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	unified := err == nil
+
+	var stats cgroupStats
+
+	if unified {
+		path := cgroups[""]
+		if path == ours[""] {
+			return cgroupStats{}, false, nil
+		}
+
+		dir := filepath.Join(cgroupRoot, path)
+
+		stats.MemoryBytes, err = readCgroupUint(filepath.Join(dir, "memory.current"))
+		if err != nil {
+			return cgroupStats{}, false, err
+		}
+
+		usageUsec, err := readCgroupStat(filepath.Join(dir, "cpu.stat"), "usage_usec")
+		if err != nil {
+			return cgroupStats{}, false, err
+		}
+
+		stats.CPUTime = time.Duration(usageUsec) * time.Microsecond
+
+		stats.Pids, err = readCgroupUint(filepath.Join(dir, "pids.current"))
+		if err != nil {
+			return cgroupStats{}, false, err
+		}
+
+		return stats, true, nil
+	}
+
+	if cgroups["memory"] == ours["memory"] {
+		return cgroupStats{}, false, nil
+	}
+
+	stats.MemoryBytes, err = readCgroupUint(filepath.Join(cgroupRoot, "memory", cgroups["memory"], "memory.usage_in_bytes"))
+	if err != nil {
+		return cgroupStats{}, false, err
+	}
+
+	usageNsec, err := readCgroupUint(filepath.Join(cgroupRoot, "cpuacct", cgroups["cpuacct"], "cpuacct.usage"))
+	if err != nil {
+		return cgroupStats{}, false, err
+	}
+
+	stats.CPUTime = time.Duration(usageNsec)
+
+	stats.Pids, err = readCgroupUint(filepath.Join(cgroupRoot, "pids", cgroups["pids"], "pids.current"))
+	if err != nil {
+		return cgroupStats{}, false, err
+	}
+
+	return stats, true, nil
+}
+
+// procCgroups maps each of a process's v1 controllers to its cgroup path;
+// its v2 cgroup path is mapped from "".
+func procCgroups(pid string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	cgroups := map[string]string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			cgroups[controller] = fields[2]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cgroups, nil
+}
+
+// readCgroupUint reads a single-value cgroup file. Files that don't exist
+// (e.g. because the controller isn't enabled) read as 0.
+func readCgroupUint(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// readCgroupStat reads a field from a flat-keyed cgroup file such as
+// cpu.stat. Missing files and fields read as 0.
+func readCgroupStat(path string, key string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parse %s in %s: %s", key, path, err)
+			}
+
+			return value, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// readOOMKills reads how many processes in the given process's cgroup have
+// been killed by the OOM killer. As with readCgroupStats, it reports false if
+// the process shares our own cgroup, or if the kernel doesn't count them.
+func readOOMKills(pid int) (uint64, bool, error) {
+	cgroups, err := procCgroups(strconv.Itoa(pid))
+	if err != nil {
+		return 0, false, err
+	}
+
+	ours, err := procCgroups("self")
+	if err != nil {
+		return 0, false, err
+	}
+
+	var path string
+
+	_, err = os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err == nil {
+		if cgroups[""] == ours[""] {
+			return 0, false, nil
+		}
+
+		path = filepath.Join(cgroupRoot, cgroups[""], "memory.events")
+	} else {
+		if cgroups["memory"] == ours["memory"] {
+			return 0, false, nil
+		}
+
+		path = filepath.Join(cgroupRoot, "memory", cgroups["memory"], "memory.oom_control")
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+
+	kills, err := readCgroupStat(path, "oom_kill")
+	if err != nil {
+		return 0, false, err
+	}
+
+	return kills, true, nil
+}
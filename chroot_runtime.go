@@ -0,0 +1,360 @@
+package gardensystemd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+)
+
+// ChrootRuntime runs wshd chrooted into the rootfs, in its own mount, PID,
+// UTS and IPC namespaces, as a child of the server. It needs neither systemd
+// nor machined, but provides much weaker isolation than nspawn and modifies
+// the rootfs in place; it is meant for CI sandboxes and development.
+type ChrootRuntime struct {
+	logger lager.Logger
+
+	// how long to wait for wshd to accept requests
+	StartTimeout time.Duration
+
+	// how long to wait after SIGTERM before killing the container
+	StopTimeout time.Duration
+
+	containers  map[string]*chrootContainer
+	containersL sync.Mutex
+}
+
+type chrootContainer struct {
+	rootfs string
+
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+var ErrContainerExited = errors.New("container exited")
+
+func NewChrootRuntime(logger lager.Logger) *ChrootRuntime {
+	return &ChrootRuntime{
+		logger: logger,
+
+		StartTimeout: 30 * time.Second,
+		StopTimeout:  10 * time.Second,
+
+		containers: make(map[string]*chrootContainer),
+	}
+}
+
+func (runtime *ChrootRuntime) Setup() error {
+	for _, bin := range []string{"unshare", "chroot", "mount"} {
+		_, err := exec.LookPath(bin)
+		if err != nil {
+			return fmt.Errorf("chroot runtime requires %s: %s", bin, err)
+		}
+	}
+
+	return nil
+}
+
+func (runtime *ChrootRuntime) Start(spec RuntimeSpec) error {
+	mounts := []string{
+		bindMount(filepath.Join(spec.Dir, "tmp"), filepath.Join(spec.RootFSPath, "tmp"), false),
+		"mkdir -p " + shellQuote(filepath.Join(spec.RootFSPath, "tmp", "garden-init")),
+		bindMount(filepath.Join(spec.Dir, "run"), filepath.Join(spec.RootFSPath, "tmp", "garden-init"), false),
+		"mkdir -p " + shellQuote(filepath.Join(spec.RootFSPath, "tmp", "garden-logs")),
+		bindMount(filepath.Join(spec.Dir, "logs"), filepath.Join(spec.RootFSPath, "tmp", "garden-logs"), false),
+		bindMount(filepath.Join(spec.Dir, "bin", "wshd"), filepath.Join(spec.RootFSPath, "sbin", "wshd"), false),
+		"mkdir -p " + shellQuote(filepath.Join(spec.RootFSPath, "dev")),
+		"mount --rbind /dev " + shellQuote(filepath.Join(spec.RootFSPath, "dev")),
+		"mkdir -p " + shellQuote(filepath.Join(spec.RootFSPath, "proc")),
+		"mount -t proc proc " + shellQuote(filepath.Join(spec.RootFSPath, "proc")),
+	}
+
+	for _, mount := range spec.BindMounts {
+		dst := filepath.Join(spec.RootFSPath, mount.DstPath)
+		mounts = append(mounts, "mkdir -p "+shellQuote(dst))
+		mounts = append(mounts, bindMount(mount.SrcPath, dst, mount.Mode == garden.BindMountModeRO))
+	}
+
+	wshdArgs := []string{"/sbin/wshd", "--run", "/tmp/garden-init", "--logs", "/tmp/garden-logs"}
+	wshdArgs = append(wshdArgs, spec.WshdFlags...)
+
+	quotedArgs := make([]string, len(wshdArgs))
+	for i, arg := range wshdArgs {
+		quotedArgs[i] = shellQuote(arg)
+	}
+
+	// unshare forks, so everything after it runs as PID 1 of the new PID
+	// namespace; --kill-child takes the namespace down with unshare
+	start := fmt.Sprintf(
+		`#!/bin/sh
+
+exec unshare --mount --pid --uts --ipc --fork --kill-child -- /bin/sh -e -c '
+%s
+hostname %s
+exec chroot %s %s
+'`,
+		strings.Replace(strings.Join(mounts, "\n"), "'", `'\''`, -1),
+		strings.Replace(shellQuote(spec.ID), "'", `'\''`, -1),
+		strings.Replace(shellQuote(spec.RootFSPath), "'", `'\''`, -1),
+		strings.Replace(strings.Join(quotedArgs, " "), "'", `'\''`, -1),
+	)
+
+	startPath := filepath.Join(spec.Dir, "start")
+
+	err := ioutil.WriteFile(startPath, []byte(start), 0755)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.OpenFile(filepath.Join(spec.Dir, "output.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+
+	cmd := exec.Command("/bin/sh", startPath)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = withoutEnv(os.Environ(), "NOTIFY_SOCKET")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// so that signals meant for the server don't reach it
+		Setpgid: true,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	container := &chrootContainer{
+		rootfs: spec.RootFSPath,
+
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		cmd.Wait()
+		close(container.exited)
+	}()
+
+	runtime.containersL.Lock()
+	runtime.containers[spec.ID] = container
+	runtime.containersL.Unlock()
+
+	err = runtime.waitForWshd(container, filepath.Join(spec.Dir, "run", "wshd.sock"))
+	if err != nil {
+		startErr := fmt.Errorf("container failed to start: %s\n\noutput:\n%s", err, tail(filepath.Join(spec.Dir, "output.log"), 20))
+
+		if err := runtime.Stop(spec.ID); err != nil {
+			runtime.logger.Error("failed-to-cleanup-container", err, lager.Data{"id": spec.ID})
+		}
+
+		return startErr
+	}
+
+	return nil
+}
+
+func (runtime *ChrootRuntime) Stop(id string) error {
+	container, found := runtime.lookup(id)
+	if !found {
+		return nil
+	}
+
+	// unshare blocks SIGTERM while it waits for its child, so the processes
+	// in the container are signalled directly; killing the namespace's init
+	// takes down the rest, and then unshare
+	err := container.kill(syscall.SIGTERM)
+	if err == nil {
+		select {
+		case <-container.exited:
+		case <-time.After(runtime.StopTimeout):
+			container.kill(syscall.SIGKILL)
+			<-container.exited
+		}
+	}
+
+	runtime.containersL.Lock()
+	delete(runtime.containers, id)
+	runtime.containersL.Unlock()
+
+	return nil
+}
+
+func (runtime *ChrootRuntime) Kill(id string, signal syscall.Signal) error {
+	container, found := runtime.lookup(id)
+	if !found {
+		return ErrContainerExited
+	}
+
+	return container.kill(signal)
+}
+
+func (runtime *ChrootRuntime) CopyIn(id string, src string, dst string) error {
+	container, found := runtime.lookup(id)
+	if !found {
+		return ErrContainerExited
+	}
+
+	return run(runtime.logger, exec.Command("cp", "-a", src+"/.", filepath.Join(container.rootfs, dst)))
+}
+
+func (runtime *ChrootRuntime) CopyOut(id string, src string, dst string) error {
+	container, found := runtime.lookup(id)
+	if !found {
+		return ErrContainerExited
+	}
+
+	// do NOT use filepath.Join; it strips out '/.'
+	return run(runtime.logger, exec.Command("cp", "-a", strings.TrimRight(container.rootfs, "/")+"/"+strings.TrimLeft(src, "/"), dst))
+}
+
+func (runtime *ChrootRuntime) Status(id string) (RuntimeStatus, error) {
+	container, found := runtime.lookup(id)
+	if !found {
+		return RuntimeStatus{}, nil
+	}
+
+	select {
+	case <-container.exited:
+		return RuntimeStatus{
+			Reason: container.cmd.ProcessState.String(),
+		}, nil
+	default:
+		return RuntimeStatus{
+			Running: true,
+			Pid:     container.cmd.Process.Pid,
+		}, nil
+	}
+}
+
+// List only knows about containers started by this server; any left behind
+// by a previous run are not children of this one, and can't be found.
+func (runtime *ChrootRuntime) List() ([]string, error) {
+	runtime.containersL.Lock()
+	defer runtime.containersL.Unlock()
+
+	ids := []string{}
+	for id := range runtime.containers {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (runtime *ChrootRuntime) lookup(id string) (*chrootContainer, bool) {
+	runtime.containersL.Lock()
+	defer runtime.containersL.Unlock()
+
+	container, found := runtime.containers[id]
+	return container, found
+}
+
+func (runtime *ChrootRuntime) waitForWshd(container *chrootContainer, socketPath string) error {
+	timeout := time.After(runtime.StartTimeout)
+
+	for {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-container.exited:
+			return ErrContainerExited
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for wshd: %s", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// kill signals every process in the container's PID namespace. Signalling
+// unshare's process group would not do; wshd and its processes are in
+// sessions of their own.
+func (container *chrootContainer) kill(signal syscall.Signal) error {
+	// unshare itself stays outside of the namespace it creates
+	namespace, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid_for_children", container.cmd.Process.Pid))
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		processNamespace, err := os.Readlink(filepath.Join("/proc", entry.Name(), "ns", "pid"))
+		if err != nil || processNamespace != namespace {
+			// it exited, or isn't in the container
+			continue
+		}
+
+		err = syscall.Kill(pid, signal)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func withoutEnv(env []string, name string) []string {
+	filtered := []string{}
+	for _, e := range env {
+		if !strings.HasPrefix(e, name+"=") {
+			filtered = append(filtered, e)
+		}
+	}
+
+	return filtered
+}
+
+func bindMount(src string, dst string, readOnly bool) string {
+	mount := "mount --bind " + shellQuote(src) + " " + shellQuote(dst)
+
+	if readOnly {
+		mount += " && mount -o remount,bind,ro " + shellQuote(dst)
+	}
+
+	return mount
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func tail(path string, lines int) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "unavailable: " + err.Error()
+	}
+
+	all := bytes.Split(bytes.TrimRight(content, "\n"), []byte("\n"))
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+
+	return string(bytes.Join(all, []byte("\n")))
+}
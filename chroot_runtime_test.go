@@ -0,0 +1,233 @@
+package gardensystemd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+// TestChrootContainer runs a container end to end on the chroot runtime. It
+// needs root, and a rootfs with a shell at $GARDEN_TEST_ROOTFS; the rootfs
+// is copied, not modified.
+func TestChrootContainer(t *testing.T) {
+	rootfs := os.Getenv("GARDEN_TEST_ROOTFS")
+	if rootfs == "" {
+		t.Skip("GARDEN_TEST_ROOTFS is not set")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "chroot-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	depotDir := filepath.Join(tmpDir, "depot")
+	skeletonDir := filepath.Join(tmpDir, "skeleton")
+	rootfsDir := filepath.Join(tmpDir, "rootfs")
+
+	err = os.MkdirAll(depotDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := exec.Command("go", "build", "-o", filepath.Join(skeletonDir, "bin", "wshd"), "./ginit/wshd")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+
+	output, err := build.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build wshd: %s\n%s", err, output)
+	}
+
+	output, err = exec.Command("cp", "-a", rootfs, rootfsDir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to copy rootfs: %s\n%s", err, output)
+	}
+
+	logger := lager.NewLogger("test")
+
+	runtime := NewChrootRuntime(logger)
+
+	backend := NewBackend(
+		logger,
+		NewMetrics(),
+		runtime,
+		depotDir,
+		skeletonDir,
+		garden.ResourceLimits{},
+		ginit.GobCodec,
+	)
+
+	err = backend.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer backend.Stop()
+
+	container, err := backend.Create(garden.ContainerSpec{
+		Handle:     "some-handle",
+		RootFSPath: "raw://" + rootfsDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("running a process", func(t *testing.T) {
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+
+		process, err := container.Run(garden.ProcessSpec{
+			Path: "/bin/sh",
+			Args: []string{"-c", "echo hello; echo oops >&2; exit 3"},
+		}, garden.ProcessIO{
+			Stdin:  new(bytes.Buffer),
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := process.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status != 3 {
+			t.Errorf("expected exit status 3, got %d", status)
+		}
+
+		if stdout.String() != "hello\n" || stderr.String() != "oops\n" {
+			t.Errorf("unexpected output: %q, %q", stdout, stderr)
+		}
+	})
+
+	t.Run("streaming in and out", func(t *testing.T) {
+		in := new(bytes.Buffer)
+
+		tarWriter := tar.NewWriter(in)
+
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:     "file",
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     5,
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tarWriter.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tarWriter.Close()
+
+		err = container.StreamIn(garden.StreamInSpec{
+			Path:      "/tmp/streamed",
+			TarStream: in,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := container.StreamOut(garden.StreamOutSpec{
+			Path: "/tmp/streamed/file",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer out.Close()
+
+		tarReader := tar.NewReader(out)
+
+		header, err := tarReader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Name != "file" || string(content) != "hello" {
+			t.Errorf("expected to stream out what was streamed in, got %s: %q", header.Name, content)
+		}
+	})
+
+	t.Run("stopping", func(t *testing.T) {
+		stdin, stdinW := io.Pipe()
+		defer stdinW.Close()
+
+		process, err := container.Run(garden.ProcessSpec{
+			Path: "/bin/sh",
+			Args: []string{"-c", "read line"},
+		}, garden.ProcessIO{
+			Stdin:  stdin,
+			Stdout: ioutil.Discard,
+			Stderr: ioutil.Discard,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = container.Stop(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exited := make(chan struct{})
+		go func() {
+			process.Wait()
+			close(exited)
+		}()
+
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected the process to be killed")
+		}
+	})
+
+	err = backend.Destroy("some-handle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := runtime.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 0 {
+		t.Errorf("expected the container to be stopped, found %v", ids)
+	}
+
+	entries, err := ioutil.ReadDir(depotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected the depot dir to be removed, found %d entries", len(entries))
+	}
+}
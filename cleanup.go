@@ -0,0 +1,113 @@
+package gardensystemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// leftovers of an interrupted operation within a container's depot dir
+var tempFilePatterns = []string{"stream-in*", "stream-out*", "metadata.json.*"}
+
+// cleanupOrphans stops and removes containers that were left behind by a
+// previous run of the server, e.g. one that crashed midway through Create or
+// Destroy. Containers the backend has adopted are kept, but any temporary
+// files left in their depot dirs are removed.
+//
+// Failures are logged rather than returned, so that the server can still
+// start; whatever was left behind is retried on the next start.
+func (backend *Backend) cleanupOrphans() {
+	log := backend.logger.Session("cleanup-orphans", lager.Data{
+		"dry-run": backend.CleanupDryRun,
+	})
+
+	log.Info("starting")
+	defer log.Info("done")
+
+	backend.containersL.RLock()
+	adopted := map[string]bool{}
+	for _, container := range backend.containers {
+		adopted[container.id] = true
+	}
+	backend.containersL.RUnlock()
+
+	// stop containers before removing their dirs, which they have mounted
+	ids, err := backend.runtime.List()
+	if err != nil {
+		log.Error("failed-to-list-containers", err)
+	}
+
+	for _, id := range ids {
+		if adopted[id] {
+			continue
+		}
+
+		log.Info("stopping-orphaned-container", lager.Data{"id": id})
+
+		if backend.CleanupDryRun {
+			continue
+		}
+
+		err := backend.runtime.Stop(id)
+		if err != nil {
+			log.Error("failed-to-stop-orphaned-container", err, lager.Data{"id": id})
+		}
+	}
+
+	entries, err := ioutil.ReadDir(backend.containersDir)
+	if err != nil {
+		log.Error("failed-to-list-depot", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "container-") {
+			continue
+		}
+
+		id := strings.TrimPrefix(entry.Name(), "container-")
+		dir := filepath.Join(backend.containersDir, entry.Name())
+
+		if adopted[id] {
+			backend.cleanupTempFiles(log, dir)
+			continue
+		}
+
+		log.Info("removing-orphaned-dir", lager.Data{"dir": dir})
+
+		if backend.CleanupDryRun {
+			continue
+		}
+
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Error("failed-to-remove-orphaned-dir", err, lager.Data{"dir": dir})
+		}
+	}
+}
+
+func (backend *Backend) cleanupTempFiles(log lager.Logger, dir string) {
+	for _, pattern := range tempFilePatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			log.Error("failed-to-find-temp-files", err, lager.Data{"dir": dir})
+			continue
+		}
+
+		for _, match := range matches {
+			log.Info("removing-temp-file", lager.Data{"path": match})
+
+			if backend.CleanupDryRun {
+				continue
+			}
+
+			err := os.RemoveAll(match)
+			if err != nil {
+				log.Error("failed-to-remove-temp-file", err, lager.Data{"path": match})
+			}
+		}
+	}
+}
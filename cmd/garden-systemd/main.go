@@ -1,15 +1,23 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
 
+	"code.cloudfoundry.org/garden"
 	"code.cloudfoundry.org/garden/server"
 	"code.cloudfoundry.org/lager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/vito/garden-systemd"
+	"github.com/vito/garden-systemd/ginit"
+	"github.com/vito/garden-systemd/systemd"
 )
 
 var listenNetwork = flag.String(
@@ -24,6 +32,12 @@ var listenAddr = flag.String(
 	"address to listen on",
 )
 
+var adminListenAddr = flag.String(
+	"adminListenAddr",
+	"",
+	"address on which to serve Prometheus metrics at /metrics, container events at /events and process output logs at /logs, and to start draining on POST /drain (disabled if empty)",
+)
+
 var containerGraceTime = flag.Duration(
 	"containerGraceTime",
 	0,
@@ -42,6 +56,40 @@ var skeletonDir = flag.String(
 	"directory containing garden-systemd utility binaries",
 )
 
+var runtimeName = flag.String(
+	"runtime",
+	"nspawn",
+	"how to run containers: 'nspawn' (via systemd) or 'chroot' (standalone, for testing)",
+)
+
+var cleanupDryRun = flag.Bool(
+	"cleanupDryRun",
+	false,
+	"only log the orphaned containers found on startup, rather than stopping and removing them",
+)
+
+var detachOnStop = flag.Bool(
+	"detachOnStop",
+	false,
+	"leave containers running when the server stops, to be adopted when it starts again, rather than destroying them (nspawn runtime only)",
+)
+
+var wshdCodecName = flag.String(
+	"wshdCodec",
+	"gob",
+	"encoding for requests to wshd: 'gob' or 'json' (wshd understands both)",
+)
+
+var defaultLimits garden.ResourceLimits
+
+func init() {
+	flag.Var(
+		rlimitFlag{&defaultLimits},
+		"rlimit",
+		"default resource limit for processes in all containers, as name=value (e.g. nofile=4096); may be given multiple times",
+	)
+}
+
 func main() {
 	flag.Parse()
 
@@ -58,7 +106,64 @@ func main() {
 		logger.Fatal("failed-to-determine-skeleton-dir", err)
 	}
 
-	backend := gardensystemd.NewBackend(depot, skeleton)
+	var runtime gardensystemd.Runtime
+	switch *runtimeName {
+	case "nspawn":
+		manager, err := systemd.NewDBusManager()
+		if err != nil {
+			logger.Fatal("failed-to-connect-to-systemd", err)
+		}
+
+		runtime = gardensystemd.NewNspawnRuntime(logger.Session("nspawn"), manager, skeleton)
+	case "chroot":
+		// its containers can't be found again by the next server
+		if *detachOnStop {
+			logger.Fatal("invalid-flags", errors.New("-detachOnStop is not supported by the chroot runtime"))
+		}
+
+		runtime = gardensystemd.NewChrootRuntime(logger.Session("chroot"))
+	default:
+		logger.Fatal("unknown-runtime", fmt.Errorf("unknown runtime: %s", *runtimeName))
+	}
+
+	var wshdCodec ginit.Codec
+	switch *wshdCodecName {
+	case "gob":
+		wshdCodec = ginit.GobCodec
+	case "json":
+		wshdCodec = ginit.JSONCodec
+	default:
+		logger.Fatal("unknown-wshd-codec", fmt.Errorf("unknown wshd codec: %s", *wshdCodecName))
+	}
+
+	metrics := gardensystemd.NewMetrics()
+
+	backend := gardensystemd.NewBackend(logger.Session("backend"), metrics, runtime, depot, skeleton, defaultLimits, wshdCodec)
+	backend.CleanupDryRun = *cleanupDryRun
+	backend.DetachOnStop = *detachOnStop
+
+	if *adminListenAddr != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(
+			metrics,
+			gardensystemd.NewContainerCollector(backend),
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		mux.Handle("/events", gardensystemd.NewEventsHandler(backend))
+		mux.Handle("/drain", gardensystemd.NewDrainHandler(backend))
+		mux.Handle("/logs", gardensystemd.NewProcessLogHandler(backend))
+
+		go func() {
+			err := http.ListenAndServe(*adminListenAddr, mux)
+			logger.Fatal("failed-to-serve-admin", err)
+		}()
+
+		logger.Info("serving-admin", lager.Data{"addr": *adminListenAddr})
+	}
 
 	gardenServer := server.New(*listenNetwork, *listenAddr, *containerGraceTime, backend, logger)
 
@@ -73,14 +178,29 @@ func main() {
 	})
 
 	signals := make(chan os.Signal, 1)
+	drainSignals := make(chan os.Signal, 1)
 
 	go func() {
-		<-signals
+		for range drainSignals {
+			logger.Info("draining")
+			backend.Drain()
+		}
+	}()
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Info("stopping", lager.Data{"signal": sig.String()})
+		case <-backend.Drained():
+			logger.Info("stopping-after-drain")
+		}
+
 		gardenServer.Stop()
 		os.Exit(0)
 	}()
 
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(drainSignals, syscall.SIGUSR1)
 
 	select {}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/garden"
+)
+
+type rlimitFlag struct {
+	limits *garden.ResourceLimits
+}
+
+func (f rlimitFlag) String() string {
+	return ""
+}
+
+func (f rlimitFlag) Set(arg string) error {
+	segs := strings.SplitN(arg, "=", 2)
+	if len(segs) != 2 {
+		return fmt.Errorf("invalid rlimit (expected name=value): %s", arg)
+	}
+
+	val, err := strconv.ParseUint(segs[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid rlimit value for %s: %s", segs[0], err)
+	}
+
+	switch segs[0] {
+	case "as":
+		f.limits.As = &val
+	case "core":
+		f.limits.Core = &val
+	case "cpu":
+		f.limits.Cpu = &val
+	case "data":
+		f.limits.Data = &val
+	case "fsize":
+		f.limits.Fsize = &val
+	case "locks":
+		f.limits.Locks = &val
+	case "memlock":
+		f.limits.Memlock = &val
+	case "msgqueue":
+		f.limits.Msgqueue = &val
+	case "nice":
+		f.limits.Nice = &val
+	case "nofile":
+		f.limits.Nofile = &val
+	case "nproc":
+		f.limits.Nproc = &val
+	case "rtprio":
+		f.limits.Rtprio = &val
+	case "sigpending":
+		f.limits.Sigpending = &val
+	case "stack":
+		f.limits.Stack = &val
+	default:
+		return fmt.Errorf("unknown rlimit: %s", segs[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vito/garden-systemd/ginit"
+	"github.com/vito/garden-systemd/ptyutil"
+)
+
+var containersDir = flag.String(
+	"depot",
+	"/var/lib/garden",
+	"directory in which containers are stored",
+)
+
+var requestTimeout = flag.Duration(
+	"timeout",
+	30*time.Second,
+	"time after which to give up on a request to wshd",
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: wsh [flags] <container> <command> [args...]
+
+<container> is a container's handle, its ID, or the path to its directory in
+the depot.
+
+commands:
+  run [-tty] [-user user] [-dir dir] [-env NAME=VALUE]... [-id id]
+      [-restart policy] [-restartBackoff d] [-maxRestartBackoff d] [-maxRestarts n]
+      [-readiness probe] [-liveness probe] [-livenessAction action]
+      [-probeInterval d] [-probeTimeout d] [-probeFailureThreshold n]
+      <path> [args...]
+  attach <process-id>
+  signal <process-id> <signal>
+  ps
+  inspect <process-id>
+  stream-in [-user user] <path>   (reads a tar stream from stdin)
+  stream-out [-user user] <path>  (writes a tar stream to stdout)
+
+flags:
+`)
+
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	dir, err := containerDir(*containersDir, flag.Arg(0))
+	if err != nil {
+		fail("%s", err)
+	}
+
+	client := ginit.NewClient(filepath.Join(dir, "run", "wshd.sock"))
+
+	command, args := flag.Arg(1), flag.Args()[2:]
+
+	var status int
+	switch command {
+	case "run":
+		status = runProcess(client, args)
+	case "attach":
+		status = attachProcess(client, args)
+	case "signal":
+		signalProcess(client, args)
+	case "ps":
+		listProcesses(client)
+	case "inspect":
+		inspectProcess(client, args)
+	case "stream-in":
+		streamIn(client, args)
+	case "stream-out":
+		streamOut(client, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	client.Close()
+	os.Exit(status)
+}
+
+// containerDir finds a container's directory in the depot.
+func containerDir(depot string, container string) (string, error) {
+	if strings.Contains(container, "/") {
+		return container, nil
+	}
+
+	byID := filepath.Join(depot, "container-"+container)
+	if _, err := os.Stat(byID); err == nil {
+		return byID, nil
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(depot, "container-*"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range dirs {
+		handle, err := ioutil.ReadFile(filepath.Join(dir, "handle"))
+		if err != nil {
+			continue
+		}
+
+		if string(handle) == container {
+			return dir, nil
+		}
+	}
+
+	return "", fmt.Errorf("container not found: %s", container)
+}
+
+func runProcess(client *ginit.Client, args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+
+	tty := flags.Bool("tty", false, "run with a pty, putting the local terminal in raw mode")
+	user := flags.String("user", "root", "user to run the process as")
+	dir := flags.String("dir", "", "working directory of the process")
+	id := flags.String("id", "", "ID to give the process (generated if empty)")
+
+	restart := flags.String("restart", ginit.RestartNever, "when to restart the process after it exits: never, on-failure, or always")
+	restartBackoff := flags.Duration("restartBackoff", 0, "delay before the first restart, doubling after each (default 1s)")
+	maxRestartBackoff := flags.Duration("maxRestartBackoff", 0, "longest delay between restarts (default 1m)")
+	maxRestarts := flags.Int("maxRestarts", 0, "number of times the process may be restarted (0 for no limit)")
+
+	readiness := flags.String("readiness", "", "readiness probe: exec:<command>, tcp:<host:port>, or an http:// URL")
+	liveness := flags.String("liveness", "", "liveness probe, in the same form as -readiness")
+	livenessAction := flags.String("livenessAction", ginit.ProbeActionNone, "what to do when the liveness probe fails: none, terminate, or kill")
+	probeInterval := flags.Duration("probeInterval", 0, "time between probes (default 10s)")
+	probeTimeout := flags.Duration("probeTimeout", 0, "time after which a probe fails (default 1s)")
+	probeFailureThreshold := flags.Int("probeFailureThreshold", 0, "consecutive failures after which a probe is failing (default 3)")
+
+	env := envFlags{}
+	flags.Var(&env, "env", "environment variable, as NAME=VALUE (may be given multiple times)")
+
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	request := &ginit.RunRequest{
+		ID:   *id,
+		Path: flags.Arg(0),
+		Args: flags.Args()[1:],
+		Env:  env,
+		Dir:  *dir,
+		User: *user,
+
+		Restart: ginit.RestartPolicy{
+			Policy:      *restart,
+			Backoff:     *restartBackoff,
+			MaxBackoff:  *maxRestartBackoff,
+			MaxRestarts: *maxRestarts,
+		},
+	}
+
+	probe := func(spec string) *ginit.Probe {
+		if spec == "" {
+			return nil
+		}
+
+		probe, err := parseProbe(spec)
+		if err != nil {
+			fail("%s", err)
+		}
+
+		probe.Interval = *probeInterval
+		probe.Timeout = *probeTimeout
+		probe.FailureThreshold = *probeFailureThreshold
+
+		return probe
+	}
+
+	request.Readiness = probe(*readiness)
+
+	request.Liveness = probe(*liveness)
+	if request.Liveness != nil {
+		request.Liveness.Action = *livenessAction
+	}
+
+	if *tty {
+		columns, rows, err := ptyutil.GetWinSize(os.Stdin)
+		if err != nil {
+			fail("stdin is not a terminal: %s", err)
+		}
+
+		request.TTY = &ginit.TTYSpec{
+			Columns: columns,
+			Rows:    rows,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	processID, files, err := client.Run(ctx, request)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "process: %s\n", processID)
+
+	status, err := interact(client, processID, files, true)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	return status
+}
+
+func attachProcess(client *ginit.Client, args []string) int {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	processID := args[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	files, err := client.Attach(ctx, processID)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	// other clients may still be writing to the process, so leave its stdin
+	// open when ours ends
+	status, err := interact(client, processID, files, false)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	return status
+}
+
+func signalProcess(client *ginit.Client, args []string) {
+	if len(args) != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	sig, err := parseSignal(args[1])
+	if err != nil {
+		fail("%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	err = client.Signal(ctx, args[0], sig)
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+func listProcesses(client *ginit.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	processes, err := client.ListProcesses(ctx)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(table, "ID\tPID\tHOST PID\tUSER\tSTARTED\tSTATE\tRESTARTS\tREADY\tCOMMAND")
+
+	for _, process := range processes {
+		state := process.State
+		if process.State == ginit.ProcessStateExited {
+			state += fmt.Sprintf(" (%d)", process.ExitStatus)
+		}
+
+		ready := "-"
+		if process.Readiness != nil {
+			ready = process.Readiness.Status
+		}
+
+		hostPid := "-"
+		if process.HostPid != 0 {
+			hostPid = strconv.Itoa(process.HostPid)
+		}
+
+		fmt.Fprintf(
+			table,
+			"%s\t%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			process.ID,
+			process.Pid,
+			hostPid,
+			process.User,
+			process.StartedAt.Format(time.RFC3339),
+			state,
+			process.Restarts,
+			ready,
+			strings.Join(append([]string{process.Path}, process.Args...), " "),
+		)
+	}
+
+	table.Flush()
+}
+
+func inspectProcess(client *ginit.Client, args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	process, err := client.InspectProcess(ctx, args[0])
+	if err != nil {
+		fail("%s", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(process)
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+func streamIn(client *ginit.Client, args []string) {
+	flags := flag.NewFlagSet("stream-in", flag.ExitOnError)
+
+	user := flags.String("user", "root", "user to create the files as")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	// no timeout; the stream may take arbitrarily long to send
+	err := client.StreamIn(context.Background(), flags.Arg(0), *user, os.Stdin)
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+func streamOut(client *ginit.Client, args []string) {
+	flags := flag.NewFlagSet("stream-out", flag.ExitOnError)
+
+	user := flags.String("user", "root", "user to read the files as")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+	defer cancel()
+
+	stream, err := client.StreamOut(ctx, flags.Arg(0), *user)
+	if err != nil {
+		fail("%s", err)
+	}
+
+	defer stream.Close()
+
+	_, err = io.Copy(os.Stdout, stream)
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+// interact streams the process's stdio to and from ours until it exits,
+// returning its exit status. It returns rather than exiting on failure, so
+// that the terminal is restored first.
+func interact(client *ginit.Client, processID string, files ginit.ProcessFiles, closeStdin bool) (int, error) {
+	// no stderr means the process has a tty
+	if files.Stderr == nil && files.Stdout != nil {
+		state, err := ptyutil.GetState(os.Stdin)
+		if err == nil {
+			defer ptyutil.Restore(os.Stdin, state)
+
+			err = ptyutil.SetRaw(os.Stdin)
+			if err != nil {
+				return 0, fmt.Errorf("set terminal to raw mode: %s", err)
+			}
+
+			go forwardWindowSize(client, processID)
+		}
+	}
+
+	if files.Stdin != nil {
+		stdin := files.Stdin
+
+		go func() {
+			_, err := io.Copy(stdin, os.Stdin)
+			if err == nil && closeStdin {
+				ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+				client.CloseStdin(ctx, processID)
+				cancel()
+			}
+
+			stdin.Close()
+		}()
+	}
+
+	copying := new(sync.WaitGroup)
+
+	if files.Stdout != nil {
+		copying.Add(1)
+		go func() {
+			io.Copy(os.Stdout, files.Stdout)
+			files.Stdout.Close()
+			copying.Done()
+		}()
+	}
+
+	if files.Stderr != nil {
+		copying.Add(1)
+		go func() {
+			io.Copy(os.Stderr, files.Stderr)
+			files.Stderr.Close()
+			copying.Done()
+		}()
+	}
+
+	copying.Wait()
+
+	var status int
+	_, err := fmt.Fscanf(files.Status, "%d", &status)
+	if err != nil {
+		return 0, fmt.Errorf("read exit status: %s", err)
+	}
+
+	return status, nil
+}
+
+// forwardWindowSize keeps the process's pty the same size as the local
+// terminal, starting with its current size.
+func forwardWindowSize(client *ginit.Client, processID string) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+
+	resized <- syscall.SIGWINCH
+
+	for range resized {
+		columns, rows, err := ptyutil.GetWinSize(os.Stdin)
+		if err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *requestTimeout)
+		client.SetWindowSize(ctx, processID, columns, rows)
+		cancel()
+	}
+}
+
+// parseProbe parses a probe given as exec:<command>, tcp:<host:port>, or an
+// http:// or https:// URL.
+func parseProbe(spec string) (*ginit.Probe, error) {
+	switch {
+	case strings.HasPrefix(spec, "exec:"):
+		command := strings.Fields(strings.TrimPrefix(spec, "exec:"))
+		if len(command) == 0 {
+			return nil, fmt.Errorf("invalid probe: no command: %s", spec)
+		}
+
+		return &ginit.Probe{
+			Exec: &ginit.ExecProbe{
+				Path: command[0],
+				Args: command[1:],
+			},
+		}, nil
+
+	case strings.HasPrefix(spec, "tcp:"):
+		return &ginit.Probe{
+			TCP: &ginit.TCPProbe{
+				Address: strings.TrimPrefix(spec, "tcp:"),
+			},
+		}, nil
+
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &ginit.Probe{
+			HTTP: &ginit.HTTPProbe{
+				URL: spec,
+			},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid probe: %s", spec)
+	}
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal accepts a signal's number or its name, with or without the
+// SIG prefix (e.g. 15, TERM, or SIGTERM).
+func parseSignal(name string) (syscall.Signal, error) {
+	num, err := strconv.Atoi(name)
+	if err == nil {
+		return syscall.Signal(num), nil
+	}
+
+	sig, found := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !found {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+
+	return sig, nil
+}
+
+type envFlags []string
+
+func (env *envFlags) String() string {
+	return strings.Join(*env, " ")
+}
+
+func (env *envFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("must be NAME=VALUE: %s", value)
+	}
+
+	*env = append(*env, value)
+	return nil
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "wsh: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -1,12 +1,10 @@
 package gardensystemd
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -16,6 +14,7 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
 	"github.com/vito/garden-systemd/ginit"
 )
 
@@ -28,12 +27,27 @@ func (err UndefinedPropertyError) Error() string {
 }
 
 type container struct {
+	logger  lager.Logger
+	metrics *Metrics
+
 	id string
 
+	runtime Runtime
+
+	wshd *ginit.Client
+
 	dir string
 
 	handle string
 
+	state  containerState
+	stateL sync.Mutex
+
+	// closed once an in-progress Destroy has finished, with destroyErr set to
+	// its outcome
+	destroyed  chan struct{}
+	destroyErr error
+
 	properties  garden.Properties
 	propertiesL sync.RWMutex
 
@@ -41,9 +55,21 @@ type container struct {
 
 	graceTime  time.Duration
 	graceTimeL sync.RWMutex
+
+	events  []ContainerEvent
+	eventsL sync.Mutex
+
+	// serializes writes of metadata.json
+	metadataL sync.Mutex
+
+	// closed to stop watching for events; watcherDone is closed once the
+	// watcher has returned
+	stopWatching     chan struct{}
+	stopWatchingOnce sync.Once
+	watcherDone      chan struct{}
 }
 
-func newContainer(spec garden.ContainerSpec, dir string, id string) *container {
+func newContainer(logger lager.Logger, metrics *Metrics, spec garden.ContainerSpec, dir string, id string, runtime Runtime, wshdCodec ginit.Codec) *container {
 	if spec.Properties == nil {
 		spec.Properties = garden.Properties{}
 	}
@@ -53,17 +79,29 @@ func newContainer(spec garden.ContainerSpec, dir string, id string) *container {
 	}
 
 	return &container{
+		logger:  logger,
+		metrics: metrics,
+
 		id: id,
 
+		runtime: runtime,
+
+		wshd: ginit.NewClientWithCodec(path.Join(dir, "run", "wshd.sock"), wshdCodec),
+
 		dir: dir,
 
 		handle: spec.Handle,
 
+		state: containerCreating,
+
 		properties: spec.Properties,
 
 		env: spec.Env,
 
 		graceTime: spec.GraceTime,
+
+		stopWatching: make(chan struct{}),
+		watcherDone:  make(chan struct{}),
 	}
 }
 
@@ -71,76 +109,200 @@ func (container *container) Handle() string {
 	return container.handle
 }
 
+// how long processes are given to exit after SIGTERM before being killed
+const stopGracePeriod = 10 * time.Second
+
+// how long to wait for wshd to respond to a request
+const wshdRequestTimeout = 30 * time.Second
+
 func (container *container) Stop(kill bool) error {
-	var signal string
-	if kill {
-		signal = "SIGKILL"
-	} else {
-		signal = "SIGTERM"
+	log := container.logger.Session("stop", lager.Data{"kill": kill})
+
+	previous, err := container.transition("stop", containerStopping, containerActive, containerStopped)
+	if err != nil {
+		log.Error("failed", err)
+		return err
 	}
 
-	return run(exec.Command("machinectl", "kill", "-s", signal, container.id))
+	err = container.stop(log, kill)
+
+	if err != nil {
+		// a Destroy that started meanwhile takes over
+		container.transition("stop", previous, containerStopping)
+		return err
+	}
+
+	container.transition("stop", containerStopped, containerStopping)
+
+	return nil
 }
 
-func (container *container) Info() (garden.ContainerInfo, error) { return garden.ContainerInfo{}, nil }
+func (container *container) stop(log lager.Logger, kill bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopGracePeriod+wshdRequestTimeout)
+	defer cancel()
+
+	err := container.wshd.Stop(ctx, kill, stopGracePeriod)
+	container.metrics.checkWshd(err)
+
+	if _, ok := err.(ginit.DialError); ok {
+		// wshd is gone; fall back to signalling everything in the container
+		signal := syscall.SIGTERM
+		if kill {
+			signal = syscall.SIGKILL
+		}
+
+		log.Info("wshd-unreachable-signalling-container", lager.Data{"signal": signal.String()})
+
+		return container.runtime.Kill(container.id, signal)
+	}
+
+	if err != nil {
+		log.Error("failed", err)
+	}
+
+	return err
+}
+
+func (container *container) Info() (garden.ContainerInfo, error) {
+	err := container.checkState("get info of")
+	if err != nil {
+		return garden.ContainerInfo{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	processes, err := container.wshd.ListProcesses(ctx)
+	container.metrics.checkWshd(err)
+
+	if err != nil {
+		return garden.ContainerInfo{}, err
+	}
+
+	processIDs := []string{}
+	for _, process := range processes {
+		if process.State == ginit.ProcessStateRunning {
+			processIDs = append(processIDs, process.ID)
+		}
+	}
+
+	events := []string{}
+	for _, event := range container.currentEvents() {
+		events = append(events, event.Message)
+	}
+
+	return garden.ContainerInfo{
+		State:      string(container.currentState()),
+		Events:     events,
+		ProcessIDs: processIDs,
+	}, nil
+}
 
 func (container *container) StreamIn(spec garden.StreamInSpec) error {
-	destDir := strings.TrimRight(spec.Path, "/")
+	log := container.logger.Session("stream-in", lager.Data{
+		"path": spec.Path,
+		"user": spec.User,
+	})
 
-	streamDir, err := ioutil.TempDir(container.dir, "stream-in")
+	err := container.checkState("stream into")
 	if err != nil {
+		log.Error("failed", err)
 		return err
 	}
 
-	defer os.RemoveAll(streamDir)
+	log.Info("starting")
 
-	tarCmd := exec.Command("tar", "xf", "-", "-C", streamDir)
-	tarCmd.Stdin = spec.TarStream
+	started := time.Now()
+
+	err = container.streamIn(log, spec)
+
+	container.metrics.observe("stream_in", started, err)
 
-	err = run(tarCmd)
 	if err != nil {
+		log.Error("failed", err, lager.Data{"duration": time.Since(started).String()})
 		return err
 	}
 
-	wshdSock := path.Join(container.dir, "run", "wshd.sock")
+	log.Info("streamed", lager.Data{"duration": time.Since(started).String()})
 
-	conn, err := net.Dial("unix", wshdSock)
+	return nil
+}
+
+func (container *container) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser, error) {
+	err := container.checkState("stream out of")
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+
+	stream, err := container.streamOut(spec)
+
+	// only until the stream starts; reading it is up to the caller
+	container.metrics.observe("stream_out", started, err)
+
+	return stream, err
+}
+
+func (container *container) streamIn(log lager.Logger, spec garden.StreamInSpec) error {
+	supported, err := container.wshdSupports(ginit.CapabilityStreamIn)
 	if err != nil {
-		println("dial wshd: " + err.Error())
 		return err
 	}
 
-	defer conn.Close()
+	if supported {
+		// no deadline; the stream may take arbitrarily long to send
+		return container.wshd.StreamIn(context.Background(), spec.Path, spec.User, spec.TarStream)
+	}
 
-	enc := gob.NewEncoder(conn)
+	// a wshd too old to stream, e.g. in an adopted container; the files are
+	// owned as in the stream, regardless of spec.User
+	log.Info("copying-in-through-runtime")
 
-	err = enc.Encode(ginit.Request{
-		CreateDir: &ginit.CreateDirRequest{
-			Path: destDir,
-		},
-	})
+	destDir := strings.TrimRight(spec.Path, "/")
+
+	streamDir, err := ioutil.TempDir(container.dir, "stream-in")
 	if err != nil {
-		println("run request: " + err.Error())
 		return err
 	}
 
-	var response ginit.Response
-	err = gob.NewDecoder(conn).Decode(&response)
+	defer os.RemoveAll(streamDir)
+
+	tarCmd := exec.Command("tar", "xf", "-", "-C", streamDir)
+	tarCmd.Stdin = spec.TarStream
+
+	err = run(log, tarCmd)
 	if err != nil {
-		println("decode response: " + err.Error())
 		return err
 	}
 
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	err = container.wshd.CreateDir(ctx, destDir)
+	if err != nil {
 		return err
 	}
 
-	return run(exec.Command("machinectl", "copy-to", container.id, streamDir, destDir))
+	return container.runtime.CopyIn(container.id, streamDir, destDir)
 }
 
-func (container *container) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser, error) {
+func (container *container) streamOut(spec garden.StreamOutSpec) (io.ReadCloser, error) {
+	supported, err := container.wshdSupports(ginit.CapabilityStreamOut)
+	if err != nil {
+		return nil, err
+	}
+
+	if supported {
+		ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+		defer cancel()
+
+		return container.wshd.StreamOut(ctx, spec.Path, spec.User)
+	}
+
+	// a wshd too old to stream; copy the files out and tar them up here
+	container.logger.Info("copying-out-through-runtime", lager.Data{"path": spec.Path})
+
 	if strings.HasSuffix(spec.Path, "/") {
 		spec.Path += "."
 	}
@@ -153,51 +315,61 @@ func (container *container) StreamOut(spec garden.StreamOutSpec) (io.ReadCloser,
 	// do NOT use path.Join; it strips out '/.'
 	streamDir := streamDirBase + "/" + path.Base(spec.Path)
 
-	err = run(exec.Command("machinectl", "copy-from", container.id, spec.Path, streamDir))
+	err = container.runtime.CopyOut(container.id, spec.Path, streamDir)
 	if err != nil {
+		os.RemoveAll(streamDirBase)
 		return nil, err
 	}
 
-	workingDir := path.Dir(streamDir)
-	compressArg := path.Base(streamDir)
-
-	tarCmd := exec.Command("tar", "cf", "-", compressArg)
-	tarCmd.Dir = workingDir
+	tarCmd := exec.Command("tar", "cf", "-", path.Base(streamDir))
+	tarCmd.Dir = path.Dir(streamDir)
 
 	out, err := tarCmd.StdoutPipe()
 	if err != nil {
+		os.RemoveAll(streamDirBase)
 		return nil, err
 	}
 
-	tarCmd.Stderr = os.Stderr
-
 	err = tarCmd.Start()
 	if err != nil {
+		os.RemoveAll(streamDirBase)
 		return nil, err
 	}
 
-	return waitCloser{
+	return tarStream{
 		ReadCloser: out,
-		proc:       tarCmd,
+		cmd:        tarCmd,
 		tmpdir:     streamDirBase,
 	}, nil
 }
 
-type waitCloser struct {
+func (container *container) wshdSupports(capability string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	supported, err := container.wshd.Supports(ctx, capability)
+	container.metrics.checkWshd(err)
+
+	return supported, err
+}
+
+// tarStream is the output of tar, which is waited for and whose input is
+// removed once it is closed.
+type tarStream struct {
 	io.ReadCloser
-	proc   *exec.Cmd
+	cmd    *exec.Cmd
 	tmpdir string
 }
 
-func (c waitCloser) Close() error {
-	defer os.RemoveAll(c.tmpdir)
+func (stream tarStream) Close() error {
+	defer os.RemoveAll(stream.tmpdir)
 
-	err := c.Close()
+	err := stream.ReadCloser.Close()
 	if err != nil {
 		return err
 	}
 
-	return c.proc.Wait()
+	return stream.cmd.Wait()
 }
 
 func (container *container) LimitBandwidth(limits garden.BandwidthLimits) error { return nil }
@@ -233,28 +405,24 @@ func (container *container) NetOut(garden.NetOutRule) error { return nil }
 func (container *container) BulkNetOut([]garden.NetOutRule) error { return nil }
 
 func (container *container) Run(spec garden.ProcessSpec, processIO garden.ProcessIO) (garden.Process, error) {
-	if spec.User == "" {
-		spec.User = "root"
-	}
-
-	wshdSock := path.Join(container.dir, "run", "wshd.sock")
-
-	conn, err := net.Dial("unix", wshdSock)
+	err := container.checkState("run a process in")
 	if err != nil {
-		println("dial wshd: " + err.Error())
 		return nil, err
 	}
 
-	defer conn.Close()
-
-	enc := gob.NewEncoder(conn)
+	if spec.User == "" {
+		spec.User = "root"
+	}
 
 	runRequest := &ginit.RunRequest{
+		ID:   spec.ID,
 		Path: spec.Path,
 		Args: spec.Args,
 		Dir:  spec.Dir,
 		Env:  append(container.env, spec.Env...),
 		User: spec.User,
+
+		Limits: resourceLimits(spec.Limits),
 	}
 
 	if spec.TTY != nil {
@@ -269,137 +437,70 @@ func (container *container) Run(spec garden.ProcessSpec, processIO garden.Proces
 		}
 	}
 
-	err = enc.Encode(ginit.Request{
-		Run: runRequest,
+	log := container.logger.Session("run", lager.Data{
+		"process-id": spec.ID,
+		"path":       spec.Path,
+		"args":       spec.Args,
+		"user":       spec.User,
 	})
-	if err != nil {
-		println("run request: " + err.Error())
-		return nil, err
-	}
 
-	var b [2048]byte
-	var oob [2048]byte
+	log.Info("starting")
 
-	n, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(b[:], oob[:])
-	if err != nil {
-		println("read unix msg: " + err.Error())
-		return nil, err
-	}
+	started := time.Now()
 
-	var response ginit.Response
-	err = gob.NewDecoder(bytes.NewBuffer(b[:n])).Decode(&response)
-	if err != nil {
-		println("decode response: " + err.Error())
-		return nil, err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
 
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
-		return nil, err
-	}
+	processID, files, err := container.wshd.Run(ctx, runRequest)
+
+	container.metrics.observe("run", started, err)
 
-	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
 	if err != nil {
-		println("parse socket control msg: " + err.Error())
+		log.Error("failed", err)
 		return nil, err
 	}
 
-	if len(scms) < 1 {
-		err := fmt.Errorf("no socket control messages received")
-		println(err.Error())
-		return nil, err
-	}
+	log.Info("started", lager.Data{"process-id": processID})
 
-	scm := scms[0]
+	return attachProcess(processID, processIO, files, container.wshd), nil
+}
 
-	fds, err := syscall.ParseUnixRights(&scm)
-	if err != nil {
-		println("parse unix rights: " + err.Error())
-		return nil, err
+func resourceLimits(limits garden.ResourceLimits) ginit.ResourceLimits {
+	return ginit.ResourceLimits{
+		As:         limits.As,
+		Core:       limits.Core,
+		Cpu:        limits.Cpu,
+		Data:       limits.Data,
+		Fsize:      limits.Fsize,
+		Locks:      limits.Locks,
+		Memlock:    limits.Memlock,
+		Msgqueue:   limits.Msgqueue,
+		Nice:       limits.Nice,
+		Nofile:     limits.Nofile,
+		Nproc:      limits.Nproc,
+		Rtprio:     limits.Rtprio,
+		Sigpending: limits.Sigpending,
+		Stack:      limits.Stack,
 	}
-
-	return attachProcess(
-		response.Run.ProcessID,
-		processIO,
-		response.Run.Rights,
-		fds,
-		wshdSock,
-	), nil
 }
 
 func (container *container) Attach(processID string, processIO garden.ProcessIO) (garden.Process, error) {
-	wshdSock := path.Join(container.dir, "run", "wshd.sock")
-
-	conn, err := net.Dial("unix", wshdSock)
+	err := container.checkState("attach to a process in")
 	if err != nil {
-		println("dial wshd: " + err.Error())
 		return nil, err
 	}
 
-	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
 
-	enc := gob.NewEncoder(conn)
+	files, err := container.wshd.Attach(ctx, processID)
+	container.metrics.checkWshd(err)
 
-	err = enc.Encode(ginit.Request{
-		Attach: &ginit.AttachRequest{
-			ProcessID: processID,
-		},
-	})
-	if err != nil {
-		println("attach request: " + err.Error())
-		return nil, err
-	}
-
-	var b [2048]byte
-	var oob [2048]byte
-
-	n, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(b[:], oob[:])
-	if err != nil {
-		println("read unix msg: " + err.Error())
-		return nil, err
-	}
-
-	var response ginit.Response
-	err = gob.NewDecoder(bytes.NewBuffer(b[:n])).Decode(&response)
-	if err != nil {
-		println("decode response: " + err.Error())
-		return nil, err
-	}
-
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
-		return nil, err
-	}
-
-	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
 	if err != nil {
-		println("parse socket control msg: " + err.Error())
 		return nil, err
 	}
 
-	if len(scms) < 1 {
-		err := fmt.Errorf("no socket control messages received")
-		println(err.Error())
-		return nil, err
-	}
-
-	scm := scms[0]
-
-	fds, err := syscall.ParseUnixRights(&scm)
-	if err != nil {
-		println("parse unix rights: " + err.Error())
-		return nil, err
-	}
-
-	return attachProcess(
-		processID,
-		processIO,
-		response.Attach.Rights,
-		fds,
-		wshdSock,
-	), nil
+	return attachProcess(processID, processIO, files, container.wshd), nil
 }
 
 func (container *container) Properties() (garden.Properties, error) {
@@ -431,21 +532,23 @@ func (container *container) SetProperty(name string, value string) error {
 	container.properties[name] = value
 	container.propertiesL.Unlock()
 
-	return nil
+	return container.saveMetadata()
 }
 
 func (container *container) RemoveProperty(name string) error {
 	container.propertiesL.Lock()
-	defer container.propertiesL.Unlock()
 
 	_, found := container.properties[name]
 	if !found {
+		container.propertiesL.Unlock()
 		return UndefinedPropertyError{name}
 	}
 
 	delete(container.properties, name)
 
-	return nil
+	container.propertiesL.Unlock()
+
+	return container.saveMetadata()
 }
 
 func (container *container) Metrics() (garden.Metrics, error) {
@@ -456,7 +559,7 @@ func (container *container) SetGraceTime(graceTime time.Duration) error {
 	container.graceTimeL.Lock()
 	container.graceTime = graceTime
 	container.graceTimeL.Unlock()
-	return nil
+	return container.saveMetadata()
 }
 
 func (container *container) currentProperties() garden.Properties {
@@ -473,6 +576,45 @@ func (container *container) currentProperties() garden.Properties {
 	return properties
 }
 
+// recordEvent adds an event to the container's metadata.
+func (container *container) recordEvent(event ContainerEvent) error {
+	container.eventsL.Lock()
+	container.events = append(container.events, event)
+	container.eventsL.Unlock()
+
+	return container.saveMetadata()
+}
+
+// saveMetadata writes the container's current metadata to its depot dir.
+func (container *container) saveMetadata() error {
+	container.metadataL.Lock()
+	defer container.metadataL.Unlock()
+
+	return writeMetadata(container.dir, containerMetadata{
+		Handle:     container.handle,
+		Properties: container.currentProperties(),
+		Env:        container.env,
+		GraceTime:  container.currentGraceTime(),
+		Events:     container.currentEvents(),
+	})
+}
+
+func (container *container) currentEvents() []ContainerEvent {
+	container.eventsL.Lock()
+	defer container.eventsL.Unlock()
+
+	return append([]ContainerEvent{}, container.events...)
+}
+
+// stopWatcher stops watching for events, waiting for the watcher to return.
+func (container *container) stopWatcher() {
+	container.stopWatchingOnce.Do(func() {
+		close(container.stopWatching)
+	})
+
+	<-container.watcherDone
+}
+
 func (container *container) currentGraceTime() time.Duration {
 	container.graceTimeL.RLock()
 	defer container.graceTimeL.RUnlock()
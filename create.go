@@ -0,0 +1,303 @@
+package gardensystemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+)
+
+// CreateError is returned when a step of creating a container failed. By
+// the time it is returned, everything done by the steps before it has been
+// undone.
+type CreateError struct {
+	Step string
+	Err  error
+}
+
+func (err CreateError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Step, err.Err)
+}
+
+func (err CreateError) Unwrap() error {
+	return err.Err
+}
+
+// createStep is one step of creating a container. If a later step fails,
+// undo is called to reverse it; it is nil for steps with nothing to undo.
+type createStep struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// runCreateSteps runs the steps in order. If one fails, those before it are
+// undone in reverse order, and its failure is returned as a CreateError.
+func runCreateSteps(log lager.Logger, steps []createStep) error {
+	for i, step := range steps {
+		log.Debug("step", lager.Data{"step": step.name})
+
+		err := step.do()
+		if err == nil {
+			continue
+		}
+
+		log.Error("step-failed", err, lager.Data{"step": step.name})
+
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].undo == nil {
+				continue
+			}
+
+			log.Info("undoing-step", lager.Data{"step": steps[j].name})
+
+			undoErr := steps[j].undo()
+			if undoErr != nil {
+				log.Error("failed-to-undo-step", undoErr, lager.Data{"step": steps[j].name})
+			}
+		}
+
+		return CreateError{Step: step.name, Err: err}
+	}
+
+	return nil
+}
+
+func (backend *Backend) create(log lager.Logger, container *container, spec garden.ContainerSpec) error {
+	id := container.id
+	dir := container.dir
+
+	// wshd includes the ID in its logs, to correlate them with ours
+	wshdFlags := []string{"--containerID", id}
+
+	defaultLimits := resourceLimits(backend.defaultLimits).ByName()
+
+	limitNames := []string{}
+	for name := range defaultLimits {
+		limitNames = append(limitNames, name)
+	}
+
+	sort.Strings(limitNames)
+
+	for _, name := range limitNames {
+		wshdFlags = append(wshdFlags, "--rlimit", name+"="+strconv.FormatUint(defaultLimits[name], 10))
+	}
+
+	var rootfsPath string
+
+	// restored if the container fails to start
+	var resolvConf *savedFile
+
+	// only removed if they didn't exist before
+	var createdSbinDir, createdWshdMountPoint bool
+
+	return runCreateSteps(log, []createStep{
+		{
+			name: "validate-rootfs",
+			do: func() error {
+				rootfsURL, err := url.Parse(spec.RootFSPath)
+				if err != nil {
+					return fmt.Errorf("invalid rootfs URI: %s", spec.RootFSPath)
+				}
+
+				if rootfsURL.Scheme != "raw" {
+					return fmt.Errorf("unsupported rootfs URI (only raw:// supported): %s", spec.RootFSPath)
+				}
+
+				rootfsPath = rootfsURL.Path
+
+				return nil
+			},
+		},
+		{
+			name: "create-depot-dir",
+			do: func() error {
+				err := os.MkdirAll(dir, 0755)
+				if err != nil {
+					return err
+				}
+
+				// lets tools on the host (e.g. wsh) find the container by its handle
+				err = ioutil.WriteFile(filepath.Join(dir, "handle"), []byte(spec.Handle), 0644)
+				if err != nil {
+					return err
+				}
+
+				for _, subdir := range []string{"run", "bin", "logs"} {
+					err := os.MkdirAll(filepath.Join(dir, subdir), 0755)
+					if err != nil {
+						return err
+					}
+				}
+
+				return os.MkdirAll(filepath.Join(dir, "tmp"), 0777)
+			},
+			undo: func() error {
+				return os.RemoveAll(dir)
+			},
+		},
+		{
+			name: "copy-wshd",
+			do: func() error {
+				return run(log, exec.Command("cp", "-a", filepath.Join(backend.skeletonDir, "bin", "wshd"), filepath.Join(dir, "bin", "wshd")))
+			},
+		},
+		{
+			name: "clear-resolv-conf",
+			do: func() error {
+				path := filepath.Join(rootfsPath, "etc", "resolv.conf")
+
+				saved, err := saveFile(path)
+				if err != nil {
+					return err
+				}
+
+				err = os.RemoveAll(path)
+				if err != nil {
+					return err
+				}
+
+				resolvConf = saved
+
+				return nil
+			},
+			undo: func() error {
+				return resolvConf.restore()
+			},
+		},
+		{
+			// to mount over (and to fool nspawn validation)
+			name: "create-wshd-mount-point",
+			do: func() error {
+				sbinDir := filepath.Join(rootfsPath, "sbin")
+
+				_, err := os.Lstat(sbinDir)
+				if os.IsNotExist(err) {
+					err = os.Mkdir(sbinDir, 0755)
+					if err != nil {
+						return err
+					}
+
+					createdSbinDir = true
+				} else if err != nil {
+					return err
+				}
+
+				wshdIsh, err := os.OpenFile(filepath.Join(sbinDir, "wshd"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+				if os.IsExist(err) {
+					return nil
+				}
+
+				if err != nil {
+					return err
+				}
+
+				createdWshdMountPoint = true
+
+				return wshdIsh.Close()
+			},
+			undo: func() error {
+				if createdWshdMountPoint {
+					err := os.Remove(filepath.Join(rootfsPath, "sbin", "wshd"))
+					if err != nil {
+						return err
+					}
+				}
+
+				if createdSbinDir {
+					return os.Remove(filepath.Join(rootfsPath, "sbin"))
+				}
+
+				return nil
+			},
+		},
+		{
+			// waits for wshd to be ready, so this fails if it times out
+			name: "start-container",
+			do: func() error {
+				return backend.runtime.Start(RuntimeSpec{
+					ID:         id,
+					Dir:        dir,
+					RootFSPath: rootfsPath,
+					BindMounts: spec.BindMounts,
+					WshdFlags:  wshdFlags,
+				})
+			},
+			undo: func() error {
+				return backend.runtime.Stop(id)
+			},
+		},
+		{
+			// last, as its presence marks the container as created
+			name: "write-metadata",
+			do:   container.saveMetadata,
+		},
+	})
+}
+
+// savedFile is a copy of a file (or symlink) that has since been removed, so
+// that it can be put back.
+type savedFile struct {
+	path string
+	mode os.FileMode
+
+	content []byte
+	link    string
+}
+
+// saveFile copies the file at path, returning nil if it doesn't exist.
+func saveFile(path string) (*savedFile, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	saved := &savedFile{
+		path: path,
+		mode: info.Mode(),
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		saved.link, err = os.Readlink(path)
+	case info.Mode().IsRegular():
+		saved.content, err = ioutil.ReadFile(path)
+	default:
+		return nil, fmt.Errorf("not a regular file or symlink: %s", path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+func (saved *savedFile) restore() error {
+	if saved == nil {
+		return nil
+	}
+
+	if saved.mode&os.ModeSymlink != 0 {
+		return os.Symlink(saved.link, saved.path)
+	}
+
+	err := ioutil.WriteFile(saved.path, saved.content, saved.mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	// WriteFile's mode is subject to the umask
+	return os.Chmod(saved.path, saved.mode.Perm())
+}
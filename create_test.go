@@ -0,0 +1,91 @@
+package gardensystemd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func TestRunCreateStepsRunsEveryStep(t *testing.T) {
+	calls := []string{}
+
+	step := func(name string) createStep {
+		return createStep{
+			name: name,
+			do: func() error {
+				calls = append(calls, "do "+name)
+				return nil
+			},
+			undo: func() error {
+				calls = append(calls, "undo "+name)
+				return nil
+			},
+		}
+	}
+
+	err := runCreateSteps(lager.NewLogger("test"), []createStep{step("a"), step("b"), step("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"do a", "do b", "do c"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestRunCreateStepsUndoesInReverseOrder(t *testing.T) {
+	calls := []string{}
+
+	step := func(name string, doErr error, undo bool) createStep {
+		step := createStep{
+			name: name,
+			do: func() error {
+				calls = append(calls, "do "+name)
+				return doErr
+			},
+		}
+
+		if undo {
+			step.undo = func() error {
+				calls = append(calls, "undo "+name)
+
+				// a failed undo doesn't stop the rest
+				return errors.New("undo failed")
+			}
+		}
+
+		return step
+	}
+
+	stepErr := errors.New("step failed")
+
+	err := runCreateSteps(lager.NewLogger("test"), []createStep{
+		step("a", nil, true),
+		step("b", nil, false),
+		step("c", nil, true),
+		step("d", stepErr, true),
+		step("e", nil, true),
+	})
+
+	createErr, ok := err.(CreateError)
+	if !ok {
+		t.Fatalf("expected a CreateError, got %#v", err)
+	}
+
+	if createErr.Step != "d" || createErr.Err != stepErr {
+		t.Errorf("expected step d to fail with %s, got %#v", stepErr, createErr)
+	}
+
+	if !errors.Is(err, stepErr) {
+		t.Error("expected the CreateError to wrap the step's error")
+	}
+
+	// the failed step cleans up after itself; steps after it never ran
+	expected := []string{"do a", "do b", "do c", "do d", "undo c", "undo a"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
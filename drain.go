@@ -0,0 +1,152 @@
+package gardensystemd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+var ErrDraining = errors.New("server is draining: not accepting new containers")
+
+// how often containers are checked for whether draining has finished
+const drainPollInterval = 5 * time.Second
+
+// Drain stops the backend from accepting new containers, and waits in the
+// background for the existing ones to finish; see Drained. Draining more
+// than once has no further effect.
+func (backend *Backend) Drain() {
+	backend.drainOnce.Do(func() {
+		close(backend.draining)
+		go backend.drain()
+	})
+}
+
+// Drained returns a channel that is closed once the backend has drained:
+// each container has no processes running, has stopped, or has had its
+// grace time pass since draining began. Containers are not destroyed by
+// draining itself.
+func (backend *Backend) Drained() <-chan struct{} {
+	return backend.drained
+}
+
+func (backend *Backend) isDraining() bool {
+	select {
+	case <-backend.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (backend *Backend) drain() {
+	log := backend.logger.Session("drain")
+
+	log.Info("starting")
+
+	started := time.Now()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		busy := backend.busyContainers(log, started)
+		if len(busy) == 0 {
+			break
+		}
+
+		log.Info("waiting-for-containers", lager.Data{"handles": busy})
+
+		<-ticker.C
+	}
+
+	log.Info("drained", lager.Data{"duration": time.Since(started).String()})
+
+	close(backend.drained)
+}
+
+// busyContainers returns the handles of the containers that draining is
+// still waiting for.
+func (backend *Backend) busyContainers(log lager.Logger, drainStarted time.Time) []string {
+	backend.containersL.RLock()
+	containers := make([]*container, 0, len(backend.containers))
+	for _, container := range backend.containers {
+		containers = append(containers, container)
+	}
+	backend.containersL.RUnlock()
+
+	busy := []string{}
+
+	for _, container := range containers {
+		switch container.currentState() {
+		case containerDestroying:
+			continue
+		case containerCreating:
+			busy = append(busy, container.handle)
+			continue
+		}
+
+		// a grace time of zero never expires
+		graceTime := container.currentGraceTime()
+		if graceTime > 0 && time.Since(drainStarted) >= graceTime {
+			continue
+		}
+
+		status, err := backend.runtime.Status(container.id)
+		if err != nil {
+			log.Error("failed-to-get-status", err, lager.Data{"handle": container.handle})
+		} else if !status.Running {
+			continue
+		}
+
+		running, err := container.hasRunningProcesses()
+		if err != nil {
+			// wait for it to come back, or for its grace time
+			log.Error("failed-to-list-processes", err, lager.Data{"handle": container.handle})
+		}
+
+		if running || err != nil {
+			busy = append(busy, container.handle)
+		}
+	}
+
+	return busy
+}
+
+func (container *container) hasRunningProcesses() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	processes, err := container.wshd.ListProcesses(ctx)
+	container.metrics.checkWshd(err)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, process := range processes {
+		if process.State == ginit.ProcessStateRunning {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// NewDrainHandler starts draining the backend when POSTed to.
+func NewDrainHandler(backend *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		backend.Drain()
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,389 @@
+package gardensystemd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+// ContainerEvent is something that happened to a container that its user
+// would want to know about, e.g. why their processes died.
+type ContainerEvent struct {
+	Handle string    `json:"handle"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+
+	// for events about a single process
+	ProcessID string `json:"process_id,omitempty"`
+
+	// reported as-is in ContainerInfo.Events
+	Message string `json:"message"`
+}
+
+const (
+	// the container's cgroup ran out of memory, and the OOM killer killed
+	// something in it
+	EventOutOfMemory = "out-of-memory"
+
+	// a process was killed by the OOM killer
+	EventProcessOutOfMemory = "process-out-of-memory"
+
+	// the container stopped without being destroyed
+	EventStoppedUnexpectedly = "stopped-unexpectedly"
+
+	// a process's readiness probe started passing or failing
+	EventProcessReady   = "process-ready"
+	EventProcessUnready = "process-unready"
+
+	// a process's liveness probe started failing
+	EventLivenessFailed = "liveness-failed"
+)
+
+// how often each container is checked for new events
+const eventPollInterval = 5 * time.Second
+
+// watch polls a container for events until it stops or is destroyed.
+func (backend *Backend) watch(container *container) {
+	defer close(container.watcherDone)
+
+	log := container.logger.Session("watch")
+
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	// an adopted container's cgroup already counts kills that were recorded
+	// before it was adopted, so only kills past the first count are events
+	oomKills, oomSeeded := backend.readContainerOOMKills(log, container)
+
+	// only changes from here on are events
+	probes, err := backend.probeStatuses(container)
+	if err != nil {
+		log.Error("failed-to-get-probe-statuses", err)
+	}
+
+	lastPolled := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-container.stopWatching:
+			return
+		}
+
+		polled := time.Now()
+
+		status, err := backend.runtime.Status(container.id)
+		if err != nil {
+			log.Error("failed-to-get-status", err)
+			continue
+		}
+
+		if !status.Running {
+			select {
+			case <-container.stopWatching:
+				// it's being destroyed
+				return
+			default:
+			}
+
+			container.transition("watch", containerStopped, containerActive, containerStopping)
+
+			message := "container stopped unexpectedly"
+			if status.Reason != "" {
+				message += ": " + status.Reason
+			}
+
+			backend.recordEvent(container, ContainerEvent{
+				Type:    EventStoppedUnexpectedly,
+				Message: message,
+			})
+
+			return
+		}
+
+		kills, found, err := readOOMKills(status.Pid)
+		if err != nil {
+			log.Error("failed-to-read-oom-kills", err)
+		} else if found && !oomSeeded {
+			oomKills, oomSeeded = kills, true
+		} else if found && kills > oomKills {
+			backend.recordOOM(container, kills-oomKills, lastPolled)
+			oomKills = kills
+		}
+
+		current, err := backend.probeStatuses(container)
+		if err != nil {
+			log.Error("failed-to-get-probe-statuses", err)
+		} else {
+			backend.recordProbeChanges(container, probes, current)
+			probes = current
+		}
+
+		lastPolled = polled
+	}
+}
+
+// readContainerOOMKills returns the number of processes the OOM killer has
+// killed in the container so far, and whether it could be read.
+func (backend *Backend) readContainerOOMKills(log lager.Logger, container *container) (uint64, bool) {
+	status, err := backend.runtime.Status(container.id)
+	if err != nil {
+		log.Error("failed-to-get-status", err)
+		return 0, false
+	}
+
+	if !status.Running {
+		return 0, false
+	}
+
+	kills, found, err := readOOMKills(status.Pid)
+	if err != nil {
+		log.Error("failed-to-read-oom-kills", err)
+		return 0, false
+	}
+
+	return kills, found
+}
+
+// recordOOM records that the OOM killer killed something in the container
+// since the given time. Processes are only named if they were SIGKILLed
+// since by something other than wshd; a kill that wshd sent, e.g. to stop
+// the process, is never taken for the OOM killer's.
+func (backend *Backend) recordOOM(container *container, kills uint64, since time.Time) {
+	backend.recordEvent(container, ContainerEvent{
+		Type:    EventOutOfMemory,
+		Message: fmt.Sprintf("out of memory: %d process(es) killed", kills),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	processes, err := container.wshd.ListProcesses(ctx)
+	container.metrics.checkWshd(err)
+
+	if err != nil {
+		container.logger.Error("failed-to-list-processes", err)
+		return
+	}
+
+	for _, process := range processes {
+		if !process.KilledExternally || process.ExitedAt.Before(since) {
+			continue
+		}
+
+		backend.recordEvent(container, ContainerEvent{
+			Type:      EventProcessOutOfMemory,
+			ProcessID: process.ID,
+			Message:   "process killed by OOM: " + process.ID,
+		})
+	}
+}
+
+// processProbes is the status of a process's probes, empty for those it
+// doesn't have.
+type processProbes struct {
+	readiness ginit.ProbeStatus
+	liveness  ginit.ProbeStatus
+}
+
+// probeStatuses returns the probe statuses of the container's processes, by
+// process ID.
+func (backend *Backend) probeStatuses(container *container) (map[string]processProbes, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
+
+	processes, err := container.wshd.ListProcesses(ctx)
+	container.metrics.checkWshd(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]processProbes{}
+
+	for _, process := range processes {
+		var probes processProbes
+
+		if process.Readiness != nil {
+			probes.readiness = *process.Readiness
+		}
+
+		if process.Liveness != nil {
+			probes.liveness = *process.Liveness
+		}
+
+		statuses[process.ID] = probes
+	}
+
+	return statuses, nil
+}
+
+// recordProbeChanges records the probes that started passing or failing
+// between two polls. Changes that are undone between polls are missed.
+func (backend *Backend) recordProbeChanges(container *container, previous map[string]processProbes, current map[string]processProbes) {
+	ids := []string{}
+	for id := range current {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		was := previous[id]
+		now := current[id]
+
+		if now.readiness.Status != was.readiness.Status {
+			switch now.readiness.Status {
+			case ginit.ProbeStatusPassing:
+				backend.recordEvent(container, ContainerEvent{
+					Type:      EventProcessReady,
+					ProcessID: id,
+					Message:   "process ready: " + id,
+				})
+
+			case ginit.ProbeStatusFailing:
+				backend.recordEvent(container, ContainerEvent{
+					Type:      EventProcessUnready,
+					ProcessID: id,
+					Message:   probeFailureMessage("process not ready: "+id, now.readiness),
+				})
+			}
+		}
+
+		if now.liveness.Status != was.liveness.Status && now.liveness.Status == ginit.ProbeStatusFailing {
+			backend.recordEvent(container, ContainerEvent{
+				Type:      EventLivenessFailed,
+				ProcessID: id,
+				Message:   probeFailureMessage("liveness probe failing: "+id, now.liveness),
+			})
+		}
+	}
+}
+
+func probeFailureMessage(message string, status ginit.ProbeStatus) string {
+	if status.LastError != "" {
+		message += " (" + status.LastError + ")"
+	}
+
+	return message
+}
+
+func (backend *Backend) recordEvent(container *container, event ContainerEvent) {
+	event.Handle = container.handle
+	event.Time = time.Now()
+
+	container.logger.Info("event", lager.Data{
+		"type":       event.Type,
+		"process-id": event.ProcessID,
+		"message":    event.Message,
+	})
+
+	err := container.recordEvent(event)
+	if err != nil {
+		container.logger.Error("failed-to-persist-event", err)
+	}
+
+	backend.metrics.event(event.Type)
+
+	backend.events.publish(event)
+}
+
+// SubscribeEvents returns a channel of the events of all containers from
+// now on, and a function to call once done with it. Events are dropped for
+// subscribers that fall behind.
+func (backend *Backend) SubscribeEvents() (<-chan ContainerEvent, func()) {
+	events := backend.events.subscribe()
+
+	return events, func() {
+		backend.events.unsubscribe(events)
+	}
+}
+
+type eventHub struct {
+	subscribers  map[chan ContainerEvent]struct{}
+	subscribersL sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan ContainerEvent]struct{}),
+	}
+}
+
+func (hub *eventHub) subscribe() chan ContainerEvent {
+	events := make(chan ContainerEvent, 64)
+
+	hub.subscribersL.Lock()
+	hub.subscribers[events] = struct{}{}
+	hub.subscribersL.Unlock()
+
+	return events
+}
+
+func (hub *eventHub) unsubscribe(events chan ContainerEvent) {
+	hub.subscribersL.Lock()
+	delete(hub.subscribers, events)
+	hub.subscribersL.Unlock()
+}
+
+func (hub *eventHub) publish(event ContainerEvent) {
+	hub.subscribersL.Lock()
+	defer hub.subscribersL.Unlock()
+
+	for events := range hub.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// NewEventsHandler streams the backend's container events as they happen, as
+// one JSON object per line. The handle query parameter limits the stream to
+// a single container.
+func NewEventsHandler(backend *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle := r.URL.Query().Get("handle")
+
+		events, unsubscribe := backend.SubscribeEvents()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		flusher, canFlush := w.(http.Flusher)
+		if canFlush {
+			flusher.Flush()
+		}
+
+		encoder := json.NewEncoder(w)
+
+		for {
+			select {
+			case event := <-events:
+				if handle != "" && event.Handle != handle {
+					continue
+				}
+
+				err := encoder.Encode(event)
+				if err != nil {
+					return
+				}
+
+				if canFlush {
+					flusher.Flush()
+				}
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,772 @@
+package ginit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Client makes requests to a wshd listening on a unix socket. Requests are
+// multiplexed over a single connection, which is established on first use
+// and re-established if it breaks. Every method gives up once its context is
+// done, so a wedged wshd can't block callers forever.
+type Client struct {
+	socketPath string
+	codec      Codec
+
+	conn *clientConn
+
+	// closed once the connection being established, if any, is ready or
+	// has failed; connL is not held while connecting
+	connecting chan struct{}
+
+	connL sync.Mutex
+}
+
+type clientConn struct {
+	frames *FrameConn
+
+	version      int
+	capabilities map[string]bool
+
+	// wshd's PID, as seen by us; 0 if unknown
+	peerPid int
+
+	nextID   uint64
+	pending  map[uint64]chan<- result
+	pendingL sync.Mutex
+
+	// closed once the connection has failed; err says why
+	broken chan struct{}
+	err    error
+}
+
+type result struct {
+	response Response
+	fds      []int
+}
+
+func NewClient(socketPath string) *Client {
+	return NewClientWithCodec(socketPath, GobCodec)
+}
+
+// NewClientWithCodec returns a client that encodes messages with the given
+// codec; wshd detects it from the Hello and replies in kind.
+func NewClientWithCodec(socketPath string, codec Codec) *Client {
+	return &Client{
+		socketPath: socketPath,
+		codec:      codec,
+	}
+}
+
+// Version returns the protocol version negotiated with wshd.
+func (client *Client) Version(ctx context.Context) (int, error) {
+	conn, err := client.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.version, nil
+}
+
+// Supports returns whether wshd can handle requests of the given capability.
+func (client *Client) Supports(ctx context.Context, capability string) (bool, error) {
+	conn, err := client.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return conn.capabilities[capability], nil
+}
+
+// Close closes the connection to wshd, if any. In-flight requests fail, but
+// the client may still be used.
+func (client *Client) Close() error {
+	client.connL.Lock()
+	conn := client.conn
+	client.conn = nil
+	client.connL.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.frames.Close()
+}
+
+// DialError is returned when wshd's socket could not be connected to.
+type DialError struct {
+	SocketPath string
+	Err        error
+}
+
+func (err DialError) Error() string {
+	return fmt.Sprintf("dial wshd at %s: %s", err.SocketPath, err.Err)
+}
+
+func (err DialError) Unwrap() error {
+	return err.Err
+}
+
+// RequestError is returned when a request could not be sent or its response
+// could not be read, including when the context expired first.
+type RequestError struct {
+	Request string
+	Err     error
+}
+
+func (err RequestError) Error() string {
+	return fmt.Sprintf("%s request: %s", err.Request, err.Err)
+}
+
+func (err RequestError) Unwrap() error {
+	return err.Err
+}
+
+// HandshakeError is returned when a connection could not agree on a protocol
+// version, e.g. because wshd is too old to speak this protocol at all.
+type HandshakeError struct {
+	Message string
+}
+
+func (err HandshakeError) Error() string {
+	return "wshd handshake failed: " + err.Message
+}
+
+// RemoteError is returned when wshd responded with an error.
+type RemoteError struct {
+	Request string
+	Message string
+}
+
+func (err RemoteError) Error() string {
+	return fmt.Sprintf("%s request: remote error: %s", err.Request, err.Message)
+}
+
+// ProcessFiles are the streams of a process, as received from wshd. Any of
+// them may be nil; see FDRights.
+type ProcessFiles struct {
+	Status *os.File
+	Stdin  *os.File
+	Stdout *os.File
+	Stderr *os.File
+}
+
+func (client *Client) Run(ctx context.Context, req *RunRequest) (string, ProcessFiles, error) {
+	response, fds, err := client.roundTrip(ctx, "run", Request{Run: req}, nil)
+	if err != nil {
+		return "", ProcessFiles{}, err
+	}
+
+	if response.Run == nil {
+		closeFDs(fds)
+		return "", ProcessFiles{}, RequestError{Request: "run", Err: errMissingResponse}
+	}
+
+	files, err := processFiles(response.Run.Rights, fds)
+	if err != nil {
+		return "", ProcessFiles{}, RequestError{Request: "run", Err: err}
+	}
+
+	return response.Run.ProcessID, files, nil
+}
+
+func (client *Client) Attach(ctx context.Context, processID string) (ProcessFiles, error) {
+	response, fds, err := client.roundTrip(ctx, "attach", Request{
+		Attach: &AttachRequest{
+			ProcessID: processID,
+		},
+	}, nil)
+	if err != nil {
+		return ProcessFiles{}, err
+	}
+
+	if response.Attach == nil {
+		closeFDs(fds)
+		return ProcessFiles{}, RequestError{Request: "attach", Err: errMissingResponse}
+	}
+
+	files, err := processFiles(response.Attach.Rights, fds)
+	if err != nil {
+		return ProcessFiles{}, RequestError{Request: "attach", Err: err}
+	}
+
+	return files, nil
+}
+
+func (client *Client) Signal(ctx context.Context, processID string, signal syscall.Signal) error {
+	return client.call(ctx, "signal", Request{
+		Signal: &SignalRequest{
+			ProcessID: processID,
+			Signal:    signal,
+		},
+	})
+}
+
+func (client *Client) SetWindowSize(ctx context.Context, processID string, columns int, rows int) error {
+	return client.call(ctx, "set window size", Request{
+		SetWindowSize: &SetWindowSizeRequest{
+			ProcessID: processID,
+			Columns:   columns,
+			Rows:      rows,
+		},
+	})
+}
+
+func (client *Client) CloseStdin(ctx context.Context, processID string) error {
+	return client.call(ctx, "close stdin", Request{
+		CloseStdin: &CloseStdinRequest{
+			ProcessID: processID,
+		},
+	})
+}
+
+func (client *Client) CreateDir(ctx context.Context, path string) error {
+	return client.call(ctx, "create dir", Request{
+		CreateDir: &CreateDirRequest{
+			Path: path,
+		},
+	})
+}
+
+func (client *Client) Stop(ctx context.Context, kill bool, gracePeriod time.Duration) error {
+	return client.call(ctx, "stop", Request{
+		Stop: &StopRequest{
+			Kill:        kill,
+			GracePeriod: gracePeriod,
+		},
+	})
+}
+
+// ListProcesses returns every process wshd knows of, in the order they were
+// started, including ones that have exited.
+func (client *Client) ListProcesses(ctx context.Context) ([]ProcessInfo, error) {
+	return client.listProcesses(ctx, "list processes", "")
+}
+
+// InspectProcess returns a single process.
+func (client *Client) InspectProcess(ctx context.Context, processID string) (ProcessInfo, error) {
+	processes, err := client.listProcesses(ctx, "inspect process", processID)
+	if err != nil {
+		return ProcessInfo{}, err
+	}
+
+	if len(processes) != 1 {
+		return ProcessInfo{}, RequestError{Request: "inspect process", Err: errMissingResponse}
+	}
+
+	return processes[0], nil
+}
+
+// listProcesses also fills in each running process's HostPid, if wshd's
+// PID namespace can be inspected (which generally requires root).
+func (client *Client) listProcesses(ctx context.Context, name string, processID string) ([]ProcessInfo, error) {
+	conn, err := client.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, fds, err := client.roundTrip(ctx, name, Request{
+		ListProcesses: &ListProcessesRequest{
+			ProcessID: processID,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	closeFDs(fds)
+
+	if response.ListProcesses == nil {
+		return nil, RequestError{Request: name, Err: errMissingResponse}
+	}
+
+	processes := response.ListProcesses.Processes
+
+	if conn.peerPid != 0 {
+		pids, err := hostPids(conn.peerPid)
+		if err == nil {
+			for i, process := range processes {
+				if process.State == ProcessStateRunning {
+					processes[i].HostPid = pids[process.Pid]
+				}
+			}
+		}
+	}
+
+	return processes, nil
+}
+
+// StreamIn extracts a tar stream into a directory in the container, as the
+// given user. The stream is passed to wshd over a pipe, so the context
+// should allow for however long it takes to send.
+func (client *Client) StreamIn(ctx context.Context, path string, user string, tarStream io.Reader) error {
+	streamR, streamW, err := os.Pipe()
+	if err != nil {
+		return RequestError{Request: "stream in", Err: err}
+	}
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(streamW, tarStream)
+		streamW.Close()
+		copied <- err
+	}()
+
+	_, fds, err := client.roundTrip(ctx, "stream in", Request{
+		StreamIn: &StreamInRequest{
+			Path: path,
+			User: user,
+		},
+	}, []int{int(streamR.Fd())})
+
+	// wshd has its own copy; closing ours makes sure the copy can't block
+	// forever writing if wshd stopped reading early
+	streamR.Close()
+
+	if err != nil {
+		// the copy may be blocked reading the stream; leave it to finish
+		return err
+	}
+
+	closeFDs(fds)
+
+	copyErr := <-copied
+	if copyErr != nil {
+		return RequestError{Request: "stream in", Err: copyErr}
+	}
+
+	return nil
+}
+
+// StreamOut returns a tar stream of a path in the container, read as the
+// given user. The stream is written by wshd as it is read; an error partway
+// through is returned from Read in place of EOF.
+func (client *Client) StreamOut(ctx context.Context, path string, user string) (io.ReadCloser, error) {
+	streamR, streamW, err := os.Pipe()
+	if err != nil {
+		return nil, RequestError{Request: "stream out", Err: err}
+	}
+
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		streamR.Close()
+		streamW.Close()
+		return nil, RequestError{Request: "stream out", Err: err}
+	}
+
+	_, fds, err := client.roundTrip(ctx, "stream out", Request{
+		StreamOut: &StreamOutRequest{
+			Path: path,
+			User: user,
+		},
+	}, []int{int(streamW.Fd()), int(statusW.Fd())})
+
+	// wshd has its own copies, so these must be closed for EOF to arrive
+	streamW.Close()
+	statusW.Close()
+
+	if err != nil {
+		streamR.Close()
+		statusR.Close()
+		return nil, err
+	}
+
+	closeFDs(fds)
+
+	return &streamOut{
+		stream: streamR,
+		status: statusR,
+	}, nil
+}
+
+type streamOut struct {
+	stream *os.File
+	status *os.File
+
+	// returned in place of EOF, once known
+	end error
+}
+
+func (s *streamOut) Read(p []byte) (int, error) {
+	if s.end != nil {
+		return 0, s.end
+	}
+
+	n, err := s.stream.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	s.end = io.EOF
+
+	status, err := ioutil.ReadAll(s.status)
+	if err != nil {
+		s.end = err
+	} else if len(status) > 0 {
+		s.end = errors.New(strings.TrimSpace(string(status)))
+	}
+
+	return n, s.end
+}
+
+func (s *streamOut) Close() error {
+	s.status.Close()
+	return s.stream.Close()
+}
+
+var errMissingResponse = fmt.Errorf("response is missing")
+
+// call makes a request for which no fds are expected in response.
+func (client *Client) call(ctx context.Context, name string, request Request) error {
+	_, fds, err := client.roundTrip(ctx, name, request, nil)
+	if err != nil {
+		return err
+	}
+
+	closeFDs(fds)
+
+	return nil
+}
+
+// roundTrip sends a request, along with copies of the given fds, and waits
+// for its response.
+func (client *Client) roundTrip(ctx context.Context, name string, request Request, fds []int) (Response, []int, error) {
+	conn, err := client.connect(ctx)
+	if err != nil {
+		return Response{}, nil, err
+	}
+
+	results := make(chan result, 1)
+
+	conn.pendingL.Lock()
+	conn.nextID++
+	request.ID = conn.nextID
+	conn.pending[request.ID] = results
+	conn.pendingL.Unlock()
+
+	err = conn.frames.WriteMessage(request, fds)
+	if err != nil {
+		conn.forget(request.ID)
+		client.fail(conn, err)
+		return Response{}, nil, RequestError{Request: name, Err: err}
+	}
+
+	select {
+	case res := <-results:
+		if res.response.Error != nil {
+			closeFDs(res.fds)
+			return Response{}, nil, RemoteError{Request: name, Message: *res.response.Error}
+		}
+
+		return res.response, res.fds, nil
+
+	case <-conn.broken:
+		conn.discard(request.ID, results)
+		return Response{}, nil, RequestError{Request: name, Err: conn.err}
+
+	case <-ctx.Done():
+		// a late response will find nothing waiting and be discarded
+		conn.discard(request.ID, results)
+		return Response{}, nil, RequestError{Request: name, Err: ctx.Err()}
+	}
+}
+
+// connect returns the current connection, establishing one if needed. Only
+// one caller connects at a time; the others wait for it, unless their own
+// context is done first.
+func (client *Client) connect(ctx context.Context) (*clientConn, error) {
+	for {
+		client.connL.Lock()
+
+		if client.conn != nil {
+			select {
+			case <-client.conn.broken:
+				client.conn = nil
+			default:
+				conn := client.conn
+				client.connL.Unlock()
+				return conn, nil
+			}
+		}
+
+		connecting := client.connecting
+		if connecting == nil {
+			break
+		}
+
+		client.connL.Unlock()
+
+		select {
+		case <-connecting:
+			// connected, or failed with the other caller's context; either
+			// way, check again
+		case <-ctx.Done():
+			return nil, DialError{SocketPath: client.socketPath, Err: ctx.Err()}
+		}
+	}
+
+	connecting := make(chan struct{})
+	client.connecting = connecting
+	client.connL.Unlock()
+
+	conn, err := client.dial(ctx)
+
+	client.connL.Lock()
+	if err == nil {
+		client.conn = conn
+	}
+	client.connecting = nil
+	client.connL.Unlock()
+
+	close(connecting)
+
+	return conn, err
+}
+
+func (client *Client) dial(ctx context.Context) (*clientConn, error) {
+	var dialer net.Dialer
+
+	netConn, err := dialer.DialContext(ctx, "unix", client.socketPath)
+	if err != nil {
+		return nil, DialError{SocketPath: client.socketPath, Err: err}
+	}
+
+	frames := NewFrameConn(netConn.(*net.UnixConn), client.codec)
+
+	helloResponse, err := handshake(ctx, frames)
+	if err != nil {
+		frames.Close()
+		return nil, err
+	}
+
+	conn := &clientConn{
+		frames: frames,
+
+		version:      helloResponse.Version,
+		capabilities: map[string]bool{},
+
+		pending: map[uint64]chan<- result{},
+
+		broken: make(chan struct{}),
+	}
+
+	for _, capability := range helloResponse.Capabilities {
+		conn.capabilities[capability] = true
+	}
+
+	// only needed for host PIDs, which are best-effort
+	conn.peerPid, _ = peerPid(netConn.(*net.UnixConn))
+
+	go client.readResponses(conn)
+
+	return conn, nil
+}
+
+// handshake negotiates the protocol version. The connection is closed if the
+// context is done first, which is what unblocks it.
+func handshake(ctx context.Context, frames *FrameConn) (response HelloResponse, err error) {
+	handshakeDone := make(chan struct{})
+	watcherDone := make(chan struct{})
+
+	canceled := false
+
+	go func() {
+		defer close(watcherDone)
+
+		select {
+		case <-ctx.Done():
+			canceled = true
+			frames.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	defer func() {
+		close(handshakeDone)
+		<-watcherDone
+
+		// it may have finished just as the connection was closed
+		if canceled && err == nil {
+			err = RequestError{Request: "hello", Err: ctx.Err()}
+		}
+	}()
+
+	err = frames.WriteMessage(Hello{
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+	}, nil)
+	if err != nil {
+		return HelloResponse{}, RequestError{Request: "hello", Err: contextErr(ctx, err)}
+	}
+
+	fds, err := frames.ReadMessage(&response)
+	if err == io.EOF {
+		return HelloResponse{}, HandshakeError{"connection closed by wshd; it may predate protocol versioning"}
+	}
+
+	if err != nil {
+		return HelloResponse{}, RequestError{Request: "hello", Err: contextErr(ctx, err)}
+	}
+
+	closeFDs(fds)
+
+	if response.Error != nil {
+		return HelloResponse{}, HandshakeError{*response.Error}
+	}
+
+	if response.Version < MinProtocolVersion || response.Version > ProtocolVersion {
+		return HelloResponse{}, HandshakeError{fmt.Sprintf("wshd chose unsupported protocol version %d", response.Version)}
+	}
+
+	return response, nil
+}
+
+func (client *Client) readResponses(conn *clientConn) {
+	for {
+		var response Response
+		fds, err := conn.frames.ReadMessage(&response)
+		if err != nil {
+			client.fail(conn, err)
+			return
+		}
+
+		results, found := conn.forget(response.ID)
+		if !found {
+			closeFDs(fds)
+			continue
+		}
+
+		results <- result{
+			response: response,
+			fds:      fds,
+		}
+	}
+}
+
+// fail marks a connection as broken, failing all in-flight requests, so that
+// the next request reconnects.
+func (client *Client) fail(conn *clientConn, err error) {
+	conn.pendingL.Lock()
+	select {
+	case <-conn.broken:
+	default:
+		conn.err = err
+		close(conn.broken)
+	}
+	conn.pendingL.Unlock()
+
+	client.connL.Lock()
+	if client.conn == conn {
+		client.conn = nil
+	}
+	client.connL.Unlock()
+
+	conn.frames.Conn().Close()
+}
+
+func (conn *clientConn) forget(id uint64) (chan<- result, bool) {
+	conn.pendingL.Lock()
+	defer conn.pendingL.Unlock()
+
+	results, found := conn.pending[id]
+	delete(conn.pending, id)
+
+	return results, found
+}
+
+// discard gives up on a request. If its response has already been claimed
+// by readResponses, it is on its way, and its fds are closed.
+func (conn *clientConn) discard(id uint64, results <-chan result) {
+	_, found := conn.forget(id)
+	if found {
+		return
+	}
+
+	res := <-results
+	closeFDs(res.fds)
+}
+
+// contextErr prefers the context's error over the timeout it caused.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+
+	scms, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	fds := []int{}
+
+	for _, scm := range scms {
+		scmFDs, err := syscall.ParseUnixRights(&scm)
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+
+		fds = append(fds, scmFDs...)
+	}
+
+	return fds, nil
+}
+
+func processFiles(rights FDRights, fds []int) (ProcessFiles, error) {
+	offsets := rights.Offsets()
+
+	expected := 0
+	for _, offset := range []*int{offsets.Status, offsets.Stdin, offsets.Stdout, offsets.Stderr} {
+		if offset != nil {
+			expected++
+		}
+	}
+
+	if len(fds) != expected {
+		closeFDs(fds)
+		return ProcessFiles{}, fmt.Errorf("expected %d fds, received %d", expected, len(fds))
+	}
+
+	var files ProcessFiles
+
+	if offsets.Status != nil {
+		files.Status = os.NewFile(uintptr(fds[*offsets.Status]), "status")
+	}
+
+	if offsets.Stdin != nil {
+		files.Stdin = os.NewFile(uintptr(fds[*offsets.Stdin]), "stdin")
+	}
+
+	if offsets.Stdout != nil {
+		files.Stdout = os.NewFile(uintptr(fds[*offsets.Stdout]), "stdout")
+	}
+
+	if offsets.Stderr != nil {
+		files.Stderr = os.NewFile(uintptr(fds[*offsets.Stderr]), "stderr")
+	}
+
+	return files, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
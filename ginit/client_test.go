@@ -0,0 +1,246 @@
+package ginit
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeWshd accepts connections on a socket in a temporary dir, handing
+// each to serve.
+type fakeWshd struct {
+	socketPath string
+
+	listener *net.UnixListener
+	tmpDir   string
+}
+
+func newFakeWshd(t *testing.T, serve func(*FrameConn)) *fakeWshd {
+	tmpDir, err := ioutil.TempDir("", "fake-wshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath := filepath.Join(tmpDir, "wshd.sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				frames := NewFrameConn(conn, GobCodec)
+				defer frames.Close()
+
+				serve(frames)
+			}()
+		}
+	}()
+
+	return &fakeWshd{
+		socketPath: socketPath,
+
+		listener: listener,
+		tmpDir:   tmpDir,
+	}
+}
+
+func (wshd *fakeWshd) Close() {
+	wshd.listener.Close()
+	os.RemoveAll(wshd.tmpDir)
+}
+
+// helloThen completes the handshake, and then answers each request with
+// respond.
+func helloThen(respond func(Request) Response) func(*FrameConn) {
+	return func(frames *FrameConn) {
+		var hello Hello
+		_, err := frames.ReadMessage(&hello)
+		if err != nil {
+			return
+		}
+
+		err = frames.WriteMessage(HelloResponse{
+			Version:      ProtocolVersion,
+			Capabilities: []string{CapabilitySignal},
+		}, nil)
+		if err != nil {
+			return
+		}
+
+		for {
+			var request Request
+			_, err := frames.ReadMessage(&request)
+			if err != nil {
+				return
+			}
+
+			response := respond(request)
+			response.ID = request.ID
+
+			err = frames.WriteMessage(response, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestClientRoundTrips(t *testing.T) {
+	wshd := newFakeWshd(t, helloThen(func(request Request) Response {
+		if request.Signal == nil || request.Signal.ProcessID != "some-process" || request.Signal.Signal != syscall.SIGTERM {
+			message := "unexpected request"
+			return Response{Error: &message}
+		}
+
+		return Response{Signal: &SignalResponse{}}
+	}))
+	defer wshd.Close()
+
+	client := NewClient(wshd.socketPath)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	supported, err := client.Supports(ctx, CapabilitySignal)
+	if err != nil || !supported {
+		t.Errorf("expected signal to be supported, got %v (%v)", supported, err)
+	}
+
+	supported, err = client.Supports(ctx, CapabilityStreamIn)
+	if err != nil || supported {
+		t.Errorf("expected stream-in not to be supported, got %v (%v)", supported, err)
+	}
+
+	err = client.Signal(ctx, "some-process", syscall.SIGTERM)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = client.Signal(ctx, "some-other-process", syscall.SIGTERM)
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("expected a RemoteError, got %#v", err)
+	}
+}
+
+func TestClientReportsWshdsThatPredateVersioning(t *testing.T) {
+	wshd := newFakeWshd(t, func(frames *FrameConn) {
+		// old wshds hang up on anything they can't decode
+		frames.ReadFrame()
+	})
+	defer wshd.Close()
+
+	client := NewClient(wshd.socketPath)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Version(ctx)
+	if _, ok := err.(HandshakeError); !ok {
+		t.Errorf("expected a HandshakeError, got %#v", err)
+	}
+}
+
+func TestClientAbandonsTheHandshakeWhenTheContextIsDone(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+
+	wshd := newFakeWshd(t, func(frames *FrameConn) {
+		<-hung
+	})
+	defer wshd.Close()
+
+	client := NewClient(wshd.socketPath)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+
+	_, err := client.Version(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %#v", err)
+	}
+
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("expected to give up at the deadline, took %s", time.Since(started))
+	}
+}
+
+func TestClientWaitsForAnotherConnectOnlyUntilItsOwnDeadline(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+
+	wshd := newFakeWshd(t, func(frames *FrameConn) {
+		<-hung
+	})
+	defer wshd.Close()
+
+	client := NewClient(wshd.socketPath)
+	defer client.Close()
+
+	slowCtx, cancelSlow := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelSlow()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := client.Version(slowCtx)
+		slowDone <- err
+	}()
+
+	// let the slow caller start connecting
+	for {
+		client.connL.Lock()
+		connecting := client.connecting != nil
+		client.connL.Unlock()
+
+		if connecting {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+
+	_, err := client.Version(ctx)
+	if _, ok := err.(DialError); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a DialError for the deadline, got %#v", err)
+	}
+
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("expected to give up at the deadline, took %s", time.Since(started))
+	}
+
+	select {
+	case err := <-slowDone:
+		t.Errorf("expected the slow caller to still be connecting, got %v", err)
+	default:
+	}
+
+	cancelSlow()
+
+	err = <-slowDone
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the slow caller to be canceled, got %#v", err)
+	}
+}
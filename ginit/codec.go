@@ -0,0 +1,67 @@
+package ginit
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec encodes the messages carried in frames. A connection uses one codec
+// throughout, chosen by the client: the server detects it from the Hello.
+type Codec interface {
+	Name() string
+	Marshal(msg interface{}) ([]byte, error)
+	Unmarshal(payload []byte, msg interface{}) error
+}
+
+var (
+	// GobCodec is the original encoding, spoken by all Go clients.
+	GobCodec Codec = gobCodec{}
+
+	// JSONCodec allows clients in other languages; see the package docs.
+	JSONCodec Codec = jsonCodec{}
+)
+
+// DetectCodec determines the codec of a connection from its first payload,
+// which must be a Hello. A JSON Hello is an object, so it begins with '{';
+// a gob-encoded Hello begins with the length of Hello's type definition,
+// which is far shorter than '{' (123 bytes).
+func DetectCodec(hello []byte) Codec {
+	trimmed := bytes.TrimLeft(hello, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return JSONCodec
+	}
+
+	return GobCodec
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(msg interface{}) ([]byte, error) {
+	payload := new(bytes.Buffer)
+
+	err := gob.NewEncoder(payload).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(payload []byte, msg interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(msg)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(payload []byte, msg interface{}) error {
+	return json.Unmarshal(payload, msg)
+}
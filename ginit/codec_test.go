@@ -0,0 +1,48 @@
+package ginit
+
+import (
+	"testing"
+)
+
+func TestDetectCodec(t *testing.T) {
+	hello := Hello{
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+	}
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		payload, err := codec.Marshal(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		detected := DetectCodec(payload)
+		if detected != codec {
+			t.Errorf("expected a %s Hello to be detected as %s, got %s", codec.Name(), codec.Name(), detected.Name())
+		}
+
+		var decoded Hello
+		err = detected.Unmarshal(payload, &decoded)
+		if err != nil {
+			t.Fatalf("%s: %s", codec.Name(), err)
+		}
+
+		if decoded != hello {
+			t.Errorf("%s: expected %#v, got %#v", codec.Name(), hello, decoded)
+		}
+	}
+}
+
+func TestDetectCodecAllowsLeadingWhitespace(t *testing.T) {
+	detected := DetectCodec([]byte("\n  {\"min_version\": 1, \"max_version\": 1}"))
+	if detected != JSONCodec {
+		t.Errorf("expected json, got %s", detected.Name())
+	}
+}
+
+func TestDetectCodecDefaultsToGob(t *testing.T) {
+	detected := DetectCodec(nil)
+	if detected != GobCodec {
+		t.Errorf("expected gob, got %s", detected.Name())
+	}
+}
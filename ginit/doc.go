@@ -0,0 +1,24 @@
+// Package ginit implements the protocol spoken between garden-systemd and the
+// wshd init process running in each container.
+//
+// wshd listens on a unix socket. Messages are sent as frames (see
+// frame.go): a 4-byte big-endian payload length, a 1-byte fd count, then the
+// payload, with any fds attached to the same sendmsg(2) as SCM_RIGHTS.
+//
+// Payloads are encoded with gob or JSON. The client picks one by how it
+// encodes its Hello, and wshd replies in kind for the rest of the connection.
+// A JSON payload is a single object, with the snake_case field names given
+// by the struct tags in msg.go; absent optional fields may be omitted.
+// Signals are sent as their numbers (e.g. 15 for SIGTERM) and durations as
+// nanoseconds.
+//
+// A JSON session, from a client that does not use Go, looks like:
+//
+//	-> {"min_version": 1, "max_version": 1}
+//	<- {"version": 1, "capabilities": ["run", "attach", "signal", ...]}
+//	-> {"id": 1, "signal": {"process_id": "web", "signal": 15}}
+//	<- {"id": 1, "signal": {}}
+//
+// Responses to run and attach carry the process's fds; their rights field
+// says which are present, in the order status, stdin, stdout, stderr.
+package ginit
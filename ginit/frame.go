@@ -0,0 +1,210 @@
+package ginit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Messages are sent as frames:
+//
+//	[4 bytes: payload length, big-endian][1 byte: fd count][payload]
+//
+// Each frame is written with a single sendmsg(2), carrying its fds (if any)
+// as SCM_RIGHTS, so a frame's fds always arrive with its header.
+const frameHeaderSize = 5
+
+const (
+	maxFramePayload = 16 * 1024 * 1024
+	maxFrameFDs     = 255
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// FrameConn reads and writes frames on a unix socket. Writes may be made
+// concurrently; reads may not.
+type FrameConn struct {
+	conn  *net.UnixConn
+	codec Codec
+
+	writeL sync.Mutex
+
+	// received but not yet returned by ReadFrame
+	buf []byte
+
+	// fds may be closed by Close while a read is in progress
+	fds    []int
+	fdsL   sync.Mutex
+	closed bool
+}
+
+func NewFrameConn(conn *net.UnixConn, codec Codec) *FrameConn {
+	return &FrameConn{
+		conn:  conn,
+		codec: codec,
+	}
+}
+
+func (c *FrameConn) Conn() *net.UnixConn {
+	return c.conn
+}
+
+func (c *FrameConn) WriteFrame(payload []byte, fds []int) error {
+	if len(payload) > maxFramePayload || len(fds) > maxFrameFDs {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	frame[4] = byte(len(fds))
+	copy(frame[frameHeaderSize:], payload)
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	c.writeL.Lock()
+	defer c.writeL.Unlock()
+
+	n, _, err := c.conn.WriteMsgUnix(frame, oob, nil)
+	if err != nil {
+		return err
+	}
+
+	// the fds went out with the first chunk; write whatever's left
+	for n < len(frame) {
+		m, err := c.conn.Write(frame[n:])
+		if err != nil {
+			return err
+		}
+
+		n += m
+	}
+
+	return nil
+}
+
+func (c *FrameConn) ReadFrame() ([]byte, []int, error) {
+	for len(c.buf) < frameHeaderSize {
+		err := c.fill()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	length := int(binary.BigEndian.Uint32(c.buf[0:4]))
+	nfds := int(c.buf[4])
+
+	if length > maxFramePayload {
+		return nil, nil, ErrFrameTooLarge
+	}
+
+	for len(c.buf) < frameHeaderSize+length {
+		err := c.fill()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	c.fdsL.Lock()
+	defer c.fdsL.Unlock()
+
+	if len(c.fds) < nfds {
+		return nil, nil, fmt.Errorf("frame expects %d fds, but only %d were received", nfds, len(c.fds))
+	}
+
+	payload := make([]byte, length)
+	copy(payload, c.buf[frameHeaderSize:frameHeaderSize+length])
+	c.buf = c.buf[frameHeaderSize+length:]
+
+	fds := make([]int, nfds)
+	copy(fds, c.fds[:nfds])
+	c.fds = c.fds[nfds:]
+
+	return payload, fds, nil
+}
+
+// SetCodec changes the codec used for messages. It must not be called
+// concurrently with reads or writes.
+func (c *FrameConn) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+// WriteMessage encodes a message into a frame.
+func (c *FrameConn) WriteMessage(msg interface{}, fds []int) error {
+	payload, err := c.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteFrame(payload, fds)
+}
+
+// ReadMessage decodes the next frame into msg, returning any fds it carried.
+func (c *FrameConn) ReadMessage(msg interface{}) ([]int, error) {
+	payload, fds, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.codec.Unmarshal(payload, msg)
+	if err != nil {
+		closeFDs(fds)
+		return nil, err
+	}
+
+	return fds, nil
+}
+
+// Close closes the connection, along with any received fds that were never
+// returned.
+func (c *FrameConn) Close() error {
+	c.fdsL.Lock()
+	closeFDs(c.fds)
+	c.fds = nil
+	c.closed = true
+	c.fdsL.Unlock()
+
+	return c.conn.Close()
+}
+
+func (c *FrameConn) fill() error {
+	var b [32 * 1024]byte
+	oob := make([]byte, syscall.CmsgSpace(maxFrameFDs*4))
+
+	n, oobn, _, _, err := c.conn.ReadMsgUnix(b[:], oob)
+	if err != nil {
+		// n and oobn may be negative; nothing was received
+		return err
+	}
+
+	if oobn > 0 {
+		fds, parseErr := parseRights(oob[:oobn])
+		if parseErr != nil {
+			return parseErr
+		}
+
+		c.fdsL.Lock()
+		if c.closed {
+			// nothing will read them now
+			closeFDs(fds)
+		} else {
+			c.fds = append(c.fds, fds...)
+		}
+		c.fdsL.Unlock()
+	}
+
+	c.buf = append(c.buf, b[:n]...)
+
+	if n == 0 {
+		// orderly shutdown by the peer
+		return io.EOF
+	}
+
+	return nil
+}
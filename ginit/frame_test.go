@@ -0,0 +1,275 @@
+package ginit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// framePair returns the two ends of a connected unix socket.
+func framePair(t *testing.T) (*FrameConn, *FrameConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*FrameConn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socket")
+
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conns[i] = NewFrameConn(conn.(*net.UnixConn), GobCodec)
+	}
+
+	return conns[0], conns[1]
+}
+
+// pipeWithContent returns the read end of a pipe that has had content
+// written to it and been closed.
+func pipeWithContent(t *testing.T, content string) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	return r
+}
+
+func readFD(t *testing.T, fd int) string {
+	file := os.NewFile(uintptr(fd), "received")
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestFramesArriveWholeAndInOrder(t *testing.T) {
+	client, server := framePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	payloads := [][]byte{
+		[]byte("first"),
+		{},
+		// larger than a single read, and than the socket's buffer
+		bytes.Repeat([]byte("x"), 1024*1024),
+		[]byte("last"),
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		for _, payload := range payloads {
+			err := client.WriteFrame(payload, nil)
+			if err != nil {
+				written <- err
+				return
+			}
+		}
+
+		written <- nil
+	}()
+
+	for i, expected := range payloads {
+		payload, fds, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+
+		if !bytes.Equal(payload, expected) {
+			t.Errorf("frame %d: expected %d bytes, got %d", i, len(expected), len(payload))
+		}
+
+		if len(fds) != 0 {
+			t.Errorf("frame %d: expected no fds, got %v", i, fds)
+		}
+	}
+
+	err := <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFDsArriveWithTheirFrames(t *testing.T) {
+	client, server := framePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	first := pipeWithContent(t, "first")
+	defer first.Close()
+
+	second := pipeWithContent(t, "second")
+	defer second.Close()
+
+	third := pipeWithContent(t, "third")
+	defer third.Close()
+
+	// written before anything is read, so that the frames and their fds are
+	// likely to be received together, and must be queued
+	frames := []struct {
+		payload string
+		files   []*os.File
+	}{
+		{"one", []*os.File{first}},
+		{"none", nil},
+		{"two", []*os.File{second, third}},
+	}
+
+	for _, frame := range frames {
+		fds := []int{}
+		for _, file := range frame.files {
+			fds = append(fds, int(file.Fd()))
+		}
+
+		err := client.WriteFrame([]byte(frame.payload), fds)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := [][]string{{"first"}, {}, {"second", "third"}}
+
+	for i, frame := range frames {
+		payload, fds, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(payload) != frame.payload {
+			t.Errorf("frame %d: expected payload %q, got %q", i, frame.payload, payload)
+		}
+
+		if len(fds) != len(expected[i]) {
+			t.Fatalf("frame %d: expected %d fds, got %d", i, len(expected[i]), len(fds))
+		}
+
+		for j, fd := range fds {
+			content := readFD(t, fd)
+			if content != expected[i][j] {
+				t.Errorf("frame %d, fd %d: expected %q, got %q", i, j, expected[i][j], content)
+			}
+		}
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		client, server := framePair(t)
+
+		client.SetCodec(codec)
+		server.SetCodec(codec)
+
+		stdout := pipeWithContent(t, "output")
+
+		err := client.WriteMessage(Response{
+			ID: 42,
+			Run: &RunResponse{
+				ProcessID: "some-process",
+			},
+		}, []int{int(stdout.Fd())})
+		if err != nil {
+			t.Fatalf("%s: %s", codec.Name(), err)
+		}
+
+		stdout.Close()
+
+		var response Response
+		fds, err := server.ReadMessage(&response)
+		if err != nil {
+			t.Fatalf("%s: %s", codec.Name(), err)
+		}
+
+		if response.ID != 42 || response.Run == nil || response.Run.ProcessID != "some-process" {
+			t.Errorf("%s: unexpected response: %#v", codec.Name(), response)
+		}
+
+		if len(fds) != 1 || readFD(t, fds[0]) != "output" {
+			t.Errorf("%s: expected the fd to come with the message, got %v", codec.Name(), fds)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWriteFrameRejectsOversizedFrames(t *testing.T) {
+	client, server := framePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	err := client.WriteFrame(make([]byte, maxFramePayload+1), nil)
+	if err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge for a large payload, got %v", err)
+	}
+
+	err = client.WriteFrame(nil, make([]int, maxFrameFDs+1))
+	if err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge for too many fds, got %v", err)
+	}
+}
+
+func TestReadFrameFailsWhenFDsAreMissing(t *testing.T) {
+	client, server := framePair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// a header claiming an fd that was never sent
+	_, err := client.Conn().Write([]byte{0, 0, 0, 2, 1, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = server.ReadFrame()
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCloseClosesQueuedFDs(t *testing.T) {
+	client, server := framePair(t)
+	defer client.Close()
+
+	file := pipeWithContent(t, "queued")
+	defer file.Close()
+
+	err := client.WriteFrame([]byte("payload"), []int{int(file.Fd())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// receive the frame without returning it
+	for len(server.fds) == 0 {
+		err := server.fill()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queued := server.fds[0]
+
+	server.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(queued), syscall.F_GETFD, 0)
+	if errno != syscall.EBADF {
+		t.Errorf("expected the queued fd to be closed, got %v", errno)
+	}
+}
@@ -2,49 +2,188 @@ package ginit
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// ProtocolVersion is the version of the protocol spoken by this package.
+//
+// Every connection begins with the client sending a Hello and the server
+// replying with a HelloResponse. After that, the client may send any number
+// of Requests, each with an ID unique to the connection; the server handles
+// them concurrently and responds to each with a Response carrying the same
+// ID, in any order.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest version this package can still speak.
+const MinProtocolVersion = 1
+
+// Capabilities name the requests a server can handle, so that clients can
+// check for support before making them.
+const (
+	CapabilityRun           = "run"
+	CapabilityAttach        = "attach"
+	CapabilitySignal        = "signal"
+	CapabilityCreateDir     = "create-dir"
+	CapabilitySetWindowSize = "set-window-size"
+	CapabilityCloseStdin    = "close-stdin"
+	CapabilityStop          = "stop"
+	CapabilityListProcesses = "list-processes"
+	CapabilityStreamIn      = "stream-in"
+	CapabilityStreamOut     = "stream-out"
+)
+
+type Hello struct {
+	// the range of protocol versions the client can speak
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+}
+
+type HelloResponse struct {
+	// the version the server chose, which the rest of the connection uses
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Error        *string  `json:"error,omitempty"`
+}
+
+// A Request must set exactly one of its request fields.
 type Request struct {
-	Run           *RunRequest
-	Attach        *AttachRequest
-	Signal        *SignalRequest
-	CreateDir     *CreateDirRequest
-	SetWindowSize *SetWindowSizeRequest
-	CloseStdin    *CloseStdinRequest
+	ID uint64 `json:"id"`
+
+	Run           *RunRequest           `json:"run,omitempty"`
+	Attach        *AttachRequest        `json:"attach,omitempty"`
+	Signal        *SignalRequest        `json:"signal,omitempty"`
+	CreateDir     *CreateDirRequest     `json:"create_dir,omitempty"`
+	SetWindowSize *SetWindowSizeRequest `json:"set_window_size,omitempty"`
+	CloseStdin    *CloseStdinRequest    `json:"close_stdin,omitempty"`
+	Stop          *StopRequest          `json:"stop,omitempty"`
+	ListProcesses *ListProcessesRequest `json:"list_processes,omitempty"`
+	StreamIn      *StreamInRequest      `json:"stream_in,omitempty"`
+	StreamOut     *StreamOutRequest     `json:"stream_out,omitempty"`
 }
 
 type Response struct {
-	Run           *RunResponse
-	Attach        *AttachResponse
-	Signal        *SignalResponse
-	CreateDir     *CreateDirResponse
-	SetWindowSize *SetWindowSizeResponse
-	CloseStdin    *CloseStdinResponse
-	Error         *string
+	ID uint64 `json:"id"`
+
+	Run           *RunResponse           `json:"run,omitempty"`
+	Attach        *AttachResponse        `json:"attach,omitempty"`
+	Signal        *SignalResponse        `json:"signal,omitempty"`
+	CreateDir     *CreateDirResponse     `json:"create_dir,omitempty"`
+	SetWindowSize *SetWindowSizeResponse `json:"set_window_size,omitempty"`
+	CloseStdin    *CloseStdinResponse    `json:"close_stdin,omitempty"`
+	Stop          *StopResponse          `json:"stop,omitempty"`
+	ListProcesses *ListProcessesResponse `json:"list_processes,omitempty"`
+	StreamIn      *StreamInResponse      `json:"stream_in,omitempty"`
+	StreamOut     *StreamOutResponse     `json:"stream_out,omitempty"`
+	Error         *string                `json:"error,omitempty"`
 }
 
 type RunRequest struct {
-	Path string
-	Args []string
-	Env  []string
-	Dir  string
-	TTY  *TTYSpec
-	User string
+	// if empty, an ID is generated; otherwise it must not belong to a process
+	// that is still running
+	ID string `json:"id"`
+
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	Env  []string `json:"env,omitempty"`
+	Dir  string   `json:"dir"`
+	TTY  *TTYSpec `json:"tty,omitempty"`
+	User string   `json:"user"`
+
+	Limits ResourceLimits `json:"limits"`
+
+	Restart RestartPolicy `json:"restart"`
+
+	// checked periodically for as long as the process runs
+	Readiness *Probe `json:"readiness,omitempty"`
+	Liveness  *Probe `json:"liveness,omitempty"`
+}
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy says whether wshd restarts a process after it exits. The
+// process keeps its ID and streams across restarts, and its exit status is
+// only reported once it is no longer going to be restarted.
+//
+// Signalling the process with SIGTERM or SIGKILL stops it from being
+// restarted, so that it can still be stopped.
+type RestartPolicy struct {
+	// RestartNever (the default), RestartOnFailure (after a non-zero exit
+	// status, including being killed by a signal), or RestartAlways
+	Policy string `json:"policy"`
+
+	// the delay before the first restart, which doubles for each consecutive
+	// restart up to MaxBackoff; they default to 1s and 1m
+	Backoff    time.Duration `json:"backoff"`     // nanoseconds, in JSON
+	MaxBackoff time.Duration `json:"max_backoff"` // nanoseconds, in JSON
+
+	// the number of times the process may be restarted; 0 means no limit
+	MaxRestarts int `json:"max_restarts"`
+}
+
+// ResourceLimits are applied with setrlimit(2) before the process is
+// executed; both the soft and hard limit are set to the given value.
+type ResourceLimits struct {
+	As         *uint64 `json:"as,omitempty"`
+	Core       *uint64 `json:"core,omitempty"`
+	Cpu        *uint64 `json:"cpu,omitempty"`
+	Data       *uint64 `json:"data,omitempty"`
+	Fsize      *uint64 `json:"fsize,omitempty"`
+	Locks      *uint64 `json:"locks,omitempty"`
+	Memlock    *uint64 `json:"memlock,omitempty"`
+	Msgqueue   *uint64 `json:"msgqueue,omitempty"`
+	Nice       *uint64 `json:"nice,omitempty"`
+	Nofile     *uint64 `json:"nofile,omitempty"`
+	Nproc      *uint64 `json:"nproc,omitempty"`
+	Rtprio     *uint64 `json:"rtprio,omitempty"`
+	Sigpending *uint64 `json:"sigpending,omitempty"`
+	Stack      *uint64 `json:"stack,omitempty"`
+}
+
+// ByName returns the limits that are set, keyed by their lowercase name
+// (e.g. "nofile").
+func (limits ResourceLimits) ByName() map[string]uint64 {
+	byName := map[string]uint64{}
+
+	set := func(name string, val *uint64) {
+		if val != nil {
+			byName[name] = *val
+		}
+	}
+
+	set("as", limits.As)
+	set("core", limits.Core)
+	set("cpu", limits.Cpu)
+	set("data", limits.Data)
+	set("fsize", limits.Fsize)
+	set("locks", limits.Locks)
+	set("memlock", limits.Memlock)
+	set("msgqueue", limits.Msgqueue)
+	set("nice", limits.Nice)
+	set("nofile", limits.Nofile)
+	set("nproc", limits.Nproc)
+	set("rtprio", limits.Rtprio)
+	set("sigpending", limits.Sigpending)
+	set("stack", limits.Stack)
+
+	return byName
 }
 
 type TTYSpec struct {
-	Columns int
-	Rows    int
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
 }
 
 type FDRights struct {
-	Status *int // should always be present
-	Stdin  *int // will not be present if already closed
-	Stdout *int // should always be present
-	Stderr *int // will not be present with tty
+	Status *int `json:"status,omitempty"` // should always be present
+	Stdin  *int `json:"stdin,omitempty"`  // will not be present if already closed
+	Stdout *int `json:"stdout,omitempty"` // should always be present
+	Stderr *int `json:"stderr,omitempty"` // will not be present with tty
 }
 
 type FDOffsets struct {
@@ -116,6 +255,11 @@ func (rights FDRights) Offsets() FDOffsets {
 }
 
 func (rights FDRights) UnixRights() []byte {
+	return syscall.UnixRights(rights.FDs()...)
+}
+
+// FDs returns the fds that are present, in the order given by Offsets.
+func (rights FDRights) FDs() []int {
 	fds := []int{}
 
 	if rights.Status != nil {
@@ -134,45 +278,210 @@ func (rights FDRights) UnixRights() []byte {
 		fds = append(fds, *rights.Stderr)
 	}
 
-	return syscall.UnixRights(fds...)
+	return fds
 }
 
 type RunResponse struct {
-	ProcessID string
-	Rights    FDRights
+	ProcessID string   `json:"process_id"`
+	Rights    FDRights `json:"rights"`
 }
 
 type AttachRequest struct {
-	ProcessID string
+	ProcessID string `json:"process_id"`
 }
 
 type AttachResponse struct {
-	Rights FDRights
+	Rights FDRights `json:"rights"`
 }
 
 type SignalRequest struct {
-	ProcessID string
-	Signal    os.Signal
+	ProcessID string         `json:"process_id"`
+	Signal    syscall.Signal `json:"signal"`
 }
 
 type SignalResponse struct{}
 
 type SetWindowSizeRequest struct {
-	ProcessID string
-	Columns   int
-	Rows      int
+	ProcessID string `json:"process_id"`
+	Columns   int    `json:"columns"`
+	Rows      int    `json:"rows"`
 }
 
 type SetWindowSizeResponse struct{}
 
 type CreateDirRequest struct {
-	Path string
+	Path string `json:"path"`
 }
 
 type CreateDirResponse struct{}
 
+// CloseStdinRequest ends a process's stdin. With a TTY, the terminal's EOF
+// character is sent instead, which only ends input at the start of a line
+// and fails if the terminal is in raw mode; the terminal stays open either
+// way.
 type CloseStdinRequest struct {
-	ProcessID string
+	ProcessID string `json:"process_id"`
 }
 
 type CloseStdinResponse struct{}
+
+// StopRequest signals every process with SIGTERM, followed by SIGKILL for
+// any still running after GracePeriod, or with SIGKILL right away if Kill is
+// set. It responds once all processes have exited; wshd itself keeps running.
+type StopRequest struct {
+	Kill        bool          `json:"kill"`
+	GracePeriod time.Duration `json:"grace_period"` // nanoseconds, in JSON
+}
+
+type StopResponse struct{}
+
+// A Probe checks on a process from within the container, by exactly one of
+// running a command (which must exit 0), connecting over TCP, or making an
+// HTTP GET (which must respond with a 2xx or 3xx status).
+type Probe struct {
+	Exec *ExecProbe `json:"exec,omitempty"`
+	TCP  *TCPProbe  `json:"tcp,omitempty"`
+	HTTP *HTTPProbe `json:"http,omitempty"`
+
+	// these default to 0, 10s, and 1s
+	InitialDelay time.Duration `json:"initial_delay"` // nanoseconds, in JSON
+	Interval     time.Duration `json:"interval"`      // nanoseconds, in JSON
+	Timeout      time.Duration `json:"timeout"`       // nanoseconds, in JSON
+
+	// the consecutive results needed to change the probe's status; they
+	// default to 3 and 1
+	FailureThreshold int `json:"failure_threshold"`
+	SuccessThreshold int `json:"success_threshold"`
+
+	// what to do to the process when a liveness probe starts failing, which
+	// does not prevent it from being restarted by its restart policy; not
+	// allowed for readiness probes
+	Action string `json:"action"`
+}
+
+type ExecProbe struct {
+	// run as the process's user
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+}
+
+type TCPProbe struct {
+	// e.g. 127.0.0.1:8080
+	Address string `json:"address"`
+}
+
+type HTTPProbe struct {
+	// e.g. http://127.0.0.1:8080/healthz
+	URL string `json:"url"`
+}
+
+const (
+	// ProbeActionNone only reports the probe's status (the default).
+	ProbeActionNone = "none"
+
+	// ProbeActionTerminate sends SIGTERM, followed by SIGKILL if the process
+	// is still running after a grace period.
+	ProbeActionTerminate = "terminate"
+
+	// ProbeActionKill sends SIGKILL.
+	ProbeActionKill = "kill"
+)
+
+const (
+	ProbeStatusUnknown = "unknown" // not enough results yet
+	ProbeStatusPassing = "passing"
+	ProbeStatusFailing = "failing"
+)
+
+type ProbeStatus struct {
+	Status string `json:"status"`
+
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// the last time the probe was run, and why it failed, if it did
+	LastProbedAt time.Time `json:"last_probed_at"`
+	LastError    string    `json:"last_error"`
+}
+
+// ListProcessesRequest returns every process wshd knows of, including ones
+// that have exited, or only the given process if ProcessID is set.
+type ListProcessesRequest struct {
+	ProcessID string `json:"process_id"`
+}
+
+type ListProcessesResponse struct {
+	Processes []ProcessInfo `json:"processes,omitempty"`
+}
+
+const (
+	ProcessStateRunning    = "running"
+	ProcessStateRestarting = "restarting" // exited, but will be restarted
+	ProcessStateExited     = "exited"
+)
+
+type ProcessInfo struct {
+	ID string `json:"id"`
+
+	// as seen from within the container; see Client.ListProcesses for the
+	// PID on the host
+	Pid     int `json:"pid"`
+	HostPid int `json:"host_pid,omitempty"`
+
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+	User string   `json:"user"`
+	TTY  bool     `json:"tty"`
+
+	StartedAt time.Time `json:"started_at"`
+
+	State string `json:"state"`
+
+	// the number of times the process has been restarted by its policy
+	Restarts int `json:"restarts"`
+
+	// only present if the process was started with the probe
+	Readiness *ProbeStatus `json:"readiness,omitempty"`
+	Liveness  *ProbeStatus `json:"liveness,omitempty"`
+
+	// only meaningful once the process has exited (gob cannot tell a pointer
+	// to zero from nil, so this is not optional)
+	ExitStatus int `json:"exit_status"`
+
+	// of the most recent exit, including one that the process was restarted
+	// after; ExitSignal is 0 unless it was killed by a signal
+	ExitSignal int       `json:"exit_signal,omitempty"`
+	ExitedAt   time.Time `json:"exited_at,omitempty"`
+
+	// whether the most recent exit was from a SIGKILL that wshd didn't send
+	// itself, i.e. not from Stop, a probe or a restart, but e.g. from the
+	// OOM killer
+	KilledExternally bool `json:"killed_externally,omitempty"`
+}
+
+// StreamInRequest extracts a tar stream into Path, which is created if
+// needed. The stream is read from the one fd sent with the request, and the
+// response is sent once it has been extracted.
+type StreamInRequest struct {
+	Path string `json:"path"`
+
+	// the files are created as this user (root if empty); only root
+	// preserves the ownership given in the stream
+	User string `json:"user"`
+}
+
+type StreamInResponse struct{}
+
+// StreamOutRequest writes a tar stream of Path, as tar(1) would with Path's
+// parent as the working directory; with a trailing slash, only the contents
+// of Path are included. It is sent with two fds: the tar stream is written
+// to the first, and the second is closed once the stream is complete, after
+// a line describing the error if it failed. The response is sent as soon as
+// the stream has started.
+type StreamOutRequest struct {
+	Path string `json:"path"`
+
+	// the files are read as this user (root if empty)
+	User string `json:"user"`
+}
+
+type StreamOutResponse struct{}
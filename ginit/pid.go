@@ -0,0 +1,100 @@
+package ginit
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// peerPid returns the PID of the process on the other end of a unix socket,
+// as seen from our own PID namespace.
+func peerPid(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if credErr != nil {
+		return 0, credErr
+	}
+
+	return int(cred.Pid), nil
+}
+
+// hostPids maps the PIDs of processes in the same PID namespace as the given
+// process to their PIDs in our own namespace, by finding each process in
+// /proc whose namespace matches and reading its innermost PID from NSpid.
+func hostPids(pid int) (map[int]int, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := map[int]int{}
+
+	for _, entry := range entries {
+		hostPid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		procNS, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", hostPid))
+		if err != nil || procNS != ns {
+			continue
+		}
+
+		nsPid, err := innermostPid(hostPid)
+		if err != nil {
+			continue
+		}
+
+		pids[nsPid] = hostPid
+	}
+
+	return pids, nil
+}
+
+func innermostPid(hostPid int) (int, error) {
+	status, err := os.Open(fmt.Sprintf("/proc/%d/status", hostPid))
+	if err != nil {
+		return 0, err
+	}
+
+	defer status.Close()
+
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "NSpid:" {
+			continue
+		}
+
+		return strconv.Atoi(fields[len(fields)-1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no NSpid in status of %d", hostPid)
+}
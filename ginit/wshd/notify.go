@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// notifyReady implements the sd_notify protocol. As the container's init,
+// wshd's notification is forwarded by systemd-nspawn (with
+// --notify-ready=yes) to systemd, which considers the unit started.
+func notifyReady() error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// don't leak the socket to processes we spawn
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	// abstract namespace socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socketPath,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("READY=1"))
+	return err
+}
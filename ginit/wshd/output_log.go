@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// rotatingLog is an append-only log file that is rotated once it grows past
+// maxBytes. Rotated files are suffixed with .1 (newest) through
+// .<maxFiles-1> (oldest); anything older is discarded.
+type rotatingLog struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	file *os.File
+	size int64
+
+	lock sync.Mutex
+}
+
+func openRotatingLog(path string, maxBytes int64, maxFiles int) (*rotatingLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &rotatingLog{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+
+		file: file,
+		size: info.Size(),
+	}, nil
+}
+
+func (log *rotatingLog) Write(p []byte) (int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if log.maxBytes > 0 && log.size > 0 && log.size+int64(len(p)) > log.maxBytes {
+		err := log.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := log.file.Write(p)
+	log.size += int64(n)
+
+	return n, err
+}
+
+func (log *rotatingLog) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return log.file.Close()
+}
+
+func (log *rotatingLog) rotate() error {
+	err := log.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if log.maxFiles > 1 {
+		for i := log.maxFiles - 1; i > 1; i-- {
+			err := os.Rename(rotatedLogPath(log.path, i-1), rotatedLogPath(log.path, i))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		err = os.Rename(log.path, rotatedLogPath(log.path, 1))
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.file = file
+	log.size = 0
+
+	return nil
+}
+
+func rotatedLogPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// outputTee copies a process's output to its log, and to each client
+// attached to it, until the process's end is closed.
+//
+// Each client gets a pipe of its own (see attach), and wshd keeps no copy of
+// its read end, so a client is attached for as long as it holds that open.
+// The tee waits for attached clients to read what they are sent, so that
+// they get all of the output from when they attached; with none attached,
+// output only goes to the log, and the process never waits on anyone.
+type outputTee struct {
+	logger lager.Logger
+
+	source *os.File
+	log    *rotatingLog
+
+	clients []*os.File
+	done    bool
+
+	lock sync.Mutex
+}
+
+func newOutputTee(logger lager.Logger, source *os.File, log *rotatingLog) *outputTee {
+	return &outputTee{
+		logger: logger,
+
+		source: source,
+		log:    log,
+	}
+}
+
+// attach returns the read end of a pipe that receives the output from here
+// on, and reaches EOF once the output has ended. The caller closes it once
+// it has been handed to the client.
+func (tee *outputTee) attach() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	tee.lock.Lock()
+	defer tee.lock.Unlock()
+
+	if tee.done {
+		w.Close()
+	} else {
+		tee.clients = append(tee.clients, w)
+	}
+
+	return r, nil
+}
+
+// run copies output until the process's end is closed, and then closes
+// everything.
+func (tee *outputTee) run() {
+	defer tee.Close()
+
+	logFailed := false
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tee.source.Read(buf)
+		if n > 0 {
+			if !logFailed {
+				_, logErr := tee.log.Write(buf[:n])
+				if logErr != nil {
+					tee.logger.Error("failed-to-write-output-log", logErr, lager.Data{"path": tee.log.path})
+					logFailed = true
+				}
+			}
+
+			tee.write(buf[:n])
+		}
+
+		if err != nil {
+			// a pty master returns EIO once the slave side is gone
+			if err != io.EOF && !isEIO(err) {
+				tee.logger.Error("failed-to-read-output", err)
+			}
+
+			return
+		}
+	}
+}
+
+// write sends output to each attached client, waiting for it to be read,
+// and detaches those that have closed their end.
+func (tee *outputTee) write(p []byte) {
+	tee.lock.Lock()
+	clients := tee.clients
+	tee.lock.Unlock()
+
+	detached := map[*os.File]bool{}
+
+	for _, client := range clients {
+		_, err := client.Write(p)
+		if err != nil {
+			if !isEPIPE(err) {
+				tee.logger.Error("failed-to-write-output", err)
+			}
+
+			client.Close()
+			detached[client] = true
+		}
+	}
+
+	if len(detached) == 0 {
+		return
+	}
+
+	tee.lock.Lock()
+	defer tee.lock.Unlock()
+
+	attached := []*os.File{}
+	for _, client := range tee.clients {
+		if !detached[client] {
+			attached = append(attached, client)
+		}
+	}
+
+	tee.clients = attached
+}
+
+// Close closes the process's end, the log, and the clients' pipes, which
+// see EOF; any clients attached later see EOF right away.
+func (tee *outputTee) Close() {
+	tee.lock.Lock()
+	defer tee.lock.Unlock()
+
+	tee.source.Close()
+	tee.log.Close()
+
+	for _, client := range tee.clients {
+		client.Close()
+	}
+
+	tee.clients = nil
+	tee.done = true
+}
+
+func isEIO(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.EIO
+}
+
+func isEPIPE(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.EPIPE
+}
+
+func processLogPath(logDir string, processID string, stream string) string {
+	return filepath.Join(logDir, processID, stream+".log")
+}
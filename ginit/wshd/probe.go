@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+const (
+	defaultProbeInterval         = 10 * time.Second
+	defaultProbeTimeout          = time.Second
+	defaultProbeFailureThreshold = 3
+	defaultProbeSuccessThreshold = 1
+
+	// how long a process has to exit after SIGTERM from a failing liveness
+	// probe before it is killed
+	livenessGracePeriod = 10 * time.Second
+)
+
+func validateProbe(probe *ginit.Probe, liveness bool) error {
+	if probe == nil {
+		return nil
+	}
+
+	checks := 0
+	for _, present := range []bool{probe.Exec != nil, probe.TCP != nil, probe.HTTP != nil} {
+		if present {
+			checks++
+		}
+	}
+
+	if checks != 1 {
+		return fmt.Errorf("invalid probe: must have exactly one of exec, tcp, or http")
+	}
+
+	if probe.InitialDelay < 0 || probe.Interval < 0 || probe.Timeout < 0 {
+		return fmt.Errorf("invalid probe: negative duration")
+	}
+
+	if probe.FailureThreshold < 0 || probe.SuccessThreshold < 0 {
+		return fmt.Errorf("invalid probe: negative threshold")
+	}
+
+	switch probe.Action {
+	case "", ginit.ProbeActionNone:
+	case ginit.ProbeActionTerminate, ginit.ProbeActionKill:
+		if !liveness {
+			return fmt.Errorf("invalid probe: readiness probes cannot have an action")
+		}
+	default:
+		return fmt.Errorf("invalid probe: unknown action: %s", probe.Action)
+	}
+
+	return nil
+}
+
+// prober runs a probe against a process, tracking its status.
+type prober struct {
+	probe    ginit.Probe
+	liveness bool
+
+	// for exec probes
+	credential *syscall.Credential
+
+	status               ginit.ProbeStatus
+	consecutiveSuccesses int
+	statusL              sync.Mutex
+}
+
+func newProber(probe ginit.Probe, liveness bool, credential *syscall.Credential) *prober {
+	if probe.Interval == 0 {
+		probe.Interval = defaultProbeInterval
+	}
+
+	if probe.Timeout == 0 {
+		probe.Timeout = defaultProbeTimeout
+	}
+
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = defaultProbeFailureThreshold
+	}
+
+	if probe.SuccessThreshold == 0 {
+		probe.SuccessThreshold = defaultProbeSuccessThreshold
+	}
+
+	return &prober{
+		probe:    probe,
+		liveness: liveness,
+
+		credential: credential,
+
+		status: ginit.ProbeStatus{
+			Status: ginit.ProbeStatusUnknown,
+		},
+	}
+}
+
+func (p *prober) Status() ginit.ProbeStatus {
+	p.statusL.Lock()
+	defer p.statusL.Unlock()
+
+	return p.status
+}
+
+// run probes the process until it has exited for good. Nothing is probed
+// while the process is waiting to be restarted.
+func (p *prober) run(process *Process) {
+	select {
+	case <-time.After(p.probe.InitialDelay):
+	case <-process.Exited:
+		return
+	}
+
+	ticker := time.NewTicker(p.probe.Interval)
+	defer ticker.Stop()
+
+	var probed *os.Process
+
+	for {
+		incarnation := process.current()
+
+		if incarnation != probed && probed != nil {
+			// each restart is judged afresh
+			p.reset()
+		}
+
+		probed = incarnation
+
+		if incarnation != nil {
+			previous := p.Status().Status
+
+			failing := p.record(p.check())
+
+			status := p.Status()
+			if status.Status != previous {
+				process.logger.Info("probe-status-changed", lager.Data{
+					"probe":  p.kind(),
+					"status": status.Status,
+					"error":  status.LastError,
+				})
+			}
+
+			if failing && p.liveness {
+				go p.act(process, incarnation)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-process.Exited:
+			return
+		}
+	}
+}
+
+func (p *prober) kind() string {
+	if p.liveness {
+		return "liveness"
+	}
+
+	return "readiness"
+}
+
+func (p *prober) reset() {
+	p.statusL.Lock()
+	p.status.Status = ginit.ProbeStatusUnknown
+	p.status.ConsecutiveFailures = 0
+	p.consecutiveSuccesses = 0
+	p.statusL.Unlock()
+}
+
+// record updates the status with the result of a probe, returning whether
+// the probe has just started failing.
+func (p *prober) record(err error) bool {
+	p.statusL.Lock()
+	defer p.statusL.Unlock()
+
+	p.status.LastProbedAt = time.Now()
+
+	if err == nil {
+		p.status.LastError = ""
+		p.status.ConsecutiveFailures = 0
+		p.consecutiveSuccesses++
+
+		if p.consecutiveSuccesses >= p.probe.SuccessThreshold {
+			p.status.Status = ginit.ProbeStatusPassing
+		}
+
+		return false
+	}
+
+	p.status.LastError = err.Error()
+	p.status.ConsecutiveFailures++
+	p.consecutiveSuccesses = 0
+
+	if p.status.ConsecutiveFailures == p.probe.FailureThreshold {
+		p.status.Status = ginit.ProbeStatusFailing
+		return true
+	}
+
+	return false
+}
+
+// act stops an incarnation of the process whose liveness probe is failing.
+func (p *prober) act(process *Process, incarnation *os.Process) {
+	switch p.probe.Action {
+	case ginit.ProbeActionTerminate:
+		process.logger.Info("liveness-probe-failing-terminating")
+
+		process.signalIncarnation(incarnation, syscall.SIGTERM)
+
+		time.Sleep(livenessGracePeriod)
+
+		if process.current() == incarnation {
+			process.logger.Info("liveness-probe-failing-killing", lager.Data{"grace-period": livenessGracePeriod.String()})
+			process.signalIncarnation(incarnation, syscall.SIGKILL)
+		}
+
+	case ginit.ProbeActionKill:
+		process.logger.Info("liveness-probe-failing-killing")
+		process.signalIncarnation(incarnation, syscall.SIGKILL)
+	}
+}
+
+func (p *prober) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.probe.Timeout)
+	defer cancel()
+
+	switch {
+	case p.probe.Exec != nil:
+		return p.checkExec(ctx)
+	case p.probe.TCP != nil:
+		return p.checkTCP(ctx)
+	case p.probe.HTTP != nil:
+		return p.checkHTTP(ctx)
+	default:
+		return errors.New("no probe configured")
+	}
+}
+
+func (p *prober) checkExec(ctx context.Context) error {
+	output := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, p.probe.Exec.Path, p.probe.Exec.Args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: p.credential,
+	}
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", p.probe.Timeout)
+	}
+
+	if err != nil {
+		line := lastLine(output.String())
+		if line != "" {
+			return fmt.Errorf("%s: %s", err, line)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (p *prober) checkTCP(ctx context.Context) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", p.probe.TCP.Address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func (p *prober) checkHTTP(ctx context.Context) error {
+	req, err := http.NewRequest("GET", p.probe.HTTP.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+
+	return nil
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
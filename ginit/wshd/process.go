@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/vito/garden-systemd/ginit"
 	"github.com/vito/garden-systemd/ptyutil"
 )
@@ -13,51 +15,378 @@ import (
 type Process struct {
 	ID string
 
-	Process *os.Process
+	// the running incarnation of the process; nil while it is waiting to be
+	// restarted
+	process *os.Process
+
+	// as requested, for listing processes
+	Path      string
+	Args      []string
+	User      string
+	StartedAt time.Time
 
 	StatusR *os.File
 	StdinW  *os.File
 	StdoutR *os.File
 	StderrR *os.File
 
+	// with output logging, each client gets its own pipe from these instead
+	// of StdoutR and StderrR
+	stdoutTee *outputTee
+	stderrTee *outputTee
+
+	// with a tty, StdinW is the pty master, which must stay open after stdin
+	// is closed so that output can still be read and the window resized
+	TTY         bool
+	stdinClosed bool
+
+	// closed once the process has exited and its status has been written
+	Exited chan struct{}
+
+	// set just before Exited is closed
+	exitStatus int
+
+	// whether wshd itself has sent SIGKILL to the running incarnation
+	killSent bool
+
+	// of the most recent incarnation to exit
+	lastExitSignal       syscall.Signal
+	lastExitedAt         time.Time
+	lastKilledExternally bool
+
+	logger lager.Logger
+
+	Restart  ginit.RestartPolicy
+	restarts int
+
+	// closed once the process must no longer be restarted
+	stopRestarting chan struct{}
+	restartStopped bool
+
+	// nil if the process has no such probe
+	readiness *prober
+	liveness  *prober
+
 	lock sync.Mutex
 }
 
-func (p *Process) Rights() ginit.FDRights {
-	return ginit.FDRights{
+// Rights returns the process's streams for a newly attached client. Any
+// files opened for the client are returned too, to be closed once they have
+// been sent.
+func (p *Process) Rights() (ginit.FDRights, []*os.File, error) {
+	stdout := p.StdoutR
+	stderr := p.StderrR
+
+	opened := []*os.File{}
+
+	if p.stdoutTee != nil {
+		client, err := p.stdoutTee.attach()
+		if err != nil {
+			return ginit.FDRights{}, nil, err
+		}
+
+		stdout = client
+		opened = append(opened, client)
+	}
+
+	if p.stderrTee != nil {
+		client, err := p.stderrTee.attach()
+		if err != nil {
+			closeFiles(opened)
+			return ginit.FDRights{}, nil, err
+		}
+
+		stderr = client
+		opened = append(opened, client)
+	}
+
+	return p.rights(stdout, stderr), opened, nil
+}
+
+func (p *Process) rights(stdout *os.File, stderr *os.File) ginit.FDRights {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rights := ginit.FDRights{
 		Status: fdRef(p.StatusR),
-		Stdin:  fdRef(p.StdinW),
-		Stdout: fdRef(p.StdoutR),
-		Stderr: fdRef(p.StderrR),
+		Stdout: fdRef(stdout),
+		Stderr: fdRef(stderr),
+	}
+
+	if !p.stdinClosed {
+		rights.Stdin = fdRef(p.StdinW)
+	}
+
+	return rights
+}
+
+func (p *Process) Running() bool {
+	select {
+	case <-p.Exited:
+		return false
+	default:
+		return true
 	}
 }
 
+// Started records the running incarnation of the process, after it was
+// first started or restarted.
+func (p *Process) Started(process *os.Process) {
+	p.lock.Lock()
+	p.process = process
+	p.killSent = false
+	p.lock.Unlock()
+}
+
+// current returns the running incarnation of the process, or nil.
+func (p *Process) current() *os.Process {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.process
+}
+
+// signalIncarnation signals an incarnation of the process, unless it has
+// since been replaced. Unlike Signal, it does not stop the process from
+// being restarted.
+func (p *Process) signalIncarnation(incarnation *os.Process, signal os.Signal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.process != incarnation {
+		return
+	}
+
+	if signal == syscall.SIGKILL {
+		p.killSent = true
+	}
+
+	err := signalGroup(incarnation, signal)
+	if err != nil {
+		p.logger.Error("failed-to-signal", err, lager.Data{"signal": signal.String()})
+	}
+}
+
+// Restarting marks the process as waiting to be restarted.
+func (p *Process) Restarting() {
+	p.lock.Lock()
+	p.process = nil
+	p.restarts++
+	p.lock.Unlock()
+}
+
+func (p *Process) Restarts() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.restarts
+}
+
+// StopRestarting prevents the process from being restarted again, cutting
+// short any backoff it is in.
+func (p *Process) StopRestarting() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.restartStopped {
+		p.restartStopped = true
+		close(p.stopRestarting)
+	}
+}
+
+func (p *Process) restartsStopped() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.restartStopped
+}
+
+// Died records that an incarnation of the process exited, whether or not it
+// will be restarted.
+func (p *Process) Died(signal syscall.Signal) {
+	p.lock.Lock()
+	p.lastExitSignal = signal
+	p.lastExitedAt = time.Now()
+	p.lastKilledExternally = signal == syscall.SIGKILL && !p.killSent
+	p.lock.Unlock()
+}
+
+// Exit records the process's exit status, marking it as exited.
+func (p *Process) Exit(status int) {
+	p.lock.Lock()
+	p.process = nil
+	p.exitStatus = status
+	p.lock.Unlock()
+
+	close(p.Exited)
+}
+
+func (p *Process) Info() ginit.ProcessInfo {
+	running := p.Running()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	info := ginit.ProcessInfo{
+		ID: p.ID,
+
+		Path: p.Path,
+		Args: p.Args,
+		User: p.User,
+		TTY:  p.TTY,
+
+		StartedAt: p.StartedAt,
+
+		State: ginit.ProcessStateRunning,
+
+		Restarts: p.restarts,
+
+		ExitSignal:       int(p.lastExitSignal),
+		ExitedAt:         p.lastExitedAt,
+		KilledExternally: p.lastKilledExternally,
+	}
+
+	if p.readiness != nil {
+		status := p.readiness.Status()
+		info.Readiness = &status
+	}
+
+	if p.liveness != nil {
+		status := p.liveness.Status()
+		info.Liveness = &status
+	}
+
+	if !running {
+		info.State = ginit.ProcessStateExited
+		info.ExitStatus = p.exitStatus
+	} else if p.process == nil {
+		info.State = ginit.ProcessStateRestarting
+	} else {
+		info.Pid = p.process.Pid
+	}
+
+	return info
+}
+
 func (p *Process) CloseStdin() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stdinClosed {
+		return nil
+	}
+
+	if p.TTY {
+		// in raw mode there is no way to end input short of hanging up the
+		// terminal, which would kill the process; that is left to the caller
+		err := ptyutil.SendEOF(p.StdinW)
+		if err != nil {
+			return err
+		}
+
+		p.stdinClosed = true
+		return nil
+	}
+
 	err := p.StdinW.Close()
 	if err != nil {
 		return err
 	}
 
 	p.StdinW = nil
+	p.stdinClosed = true
 
 	return nil
 }
 
+// Close releases wshd's ends of the process's streams. Clients that are
+// attached have their own copies and are unaffected.
+func (p *Process) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, file := range []*os.File{p.StatusR, p.StdinW, p.StdoutR, p.StderrR} {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
 func (p *Process) SetWindowSize(columns, rows int) error {
-	println("updating pty size to: " + strconv.Itoa(columns) + "x" + strconv.Itoa(rows))
+	p.logger.Debug("set-window-size", lager.Data{
+		"columns": columns,
+		"rows":    rows,
+	})
 
 	err := ptyutil.SetWinSize(p.StdinW, columns, rows)
 	if err != nil {
 		return err
 	}
 
-	println("sending SIGWINCH to " + strconv.Itoa(p.Process.Pid))
+	p.lock.Lock()
+	process := p.process
+	p.lock.Unlock()
+
+	if process == nil {
+		// not running; the next incarnation starts with the new size
+		return nil
+	}
 
-	return p.Process.Signal(syscall.SIGWINCH)
+	return process.Signal(syscall.SIGWINCH)
 }
 
+// Signal sends a signal to the running incarnation of the process. SIGTERM
+// and SIGKILL are sent to its whole process group, so that its children stop
+// too, and also stop it from being restarted.
 func (p *Process) Signal(signal os.Signal) error {
-	return p.Process.Signal(signal)
+	if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+		p.StopRestarting()
+	}
+
+	p.lock.Lock()
+	process := p.process
+	if process != nil && signal == syscall.SIGKILL {
+		p.killSent = true
+	}
+	p.lock.Unlock()
+
+	if process == nil {
+		if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+			// it was waiting to be restarted, and now won't be
+			return nil
+		}
+
+		return fmt.Errorf("process is not running: %s", p.ID)
+	}
+
+	if signal == syscall.SIGTERM || signal == syscall.SIGKILL {
+		return signalGroup(process, signal)
+	}
+
+	return process.Signal(signal)
+}
+
+// signalGroup signals the process group that an incarnation of a process
+// leads; each is started in its own group (or session, with a tty).
+func signalGroup(process *os.Process, signal os.Signal) error {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return process.Signal(signal)
+	}
+
+	err := syscall.Kill(-process.Pid, sig)
+	if err == syscall.ESRCH {
+		// the group is gone, but the leader may not have been reaped yet
+		return process.Signal(signal)
+	}
+
+	return err
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
 }
 
 func fdRef(file *os.File) *int {
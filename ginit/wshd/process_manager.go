@@ -3,40 +3,71 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/kr/pty"
 	"github.com/nu7hatch/gouuid"
 	"github.com/vito/garden-systemd/ginit"
 	"github.com/vito/garden-systemd/ptyutil"
 )
 
-func newProcessManager() *ProcessManager {
+func newProcessManager(logger lager.Logger, logDir string, logMaxBytes int64, logMaxFiles int, defaultRlimits map[string]uint64) *ProcessManager {
 	return &ProcessManager{
+		logger: logger,
+
 		processes: make(map[string]*Process),
+		pending:   make(map[string]bool),
+
+		defaultRlimits: defaultRlimits,
+
+		logDir:      logDir,
+		logMaxBytes: logMaxBytes,
+		logMaxFiles: logMaxFiles,
 	}
 }
 
 type ProcessManager struct {
+	logger lager.Logger
+
 	processes  map[string]*Process
 	processesL sync.Mutex
+
+	// IDs of processes that are being started
+	pending map[string]bool
+
+	// applied to every process, unless overridden by the request
+	defaultRlimits map[string]uint64
+
+	// if empty, process output is not persisted
+	logDir      string
+	logMaxBytes int64
+	logMaxFiles int
 }
 
-func (mgr *ProcessManager) Run(conn net.Conn, req *ginit.RunRequest) {
+func (mgr *ProcessManager) Run(res *responder, req *ginit.RunRequest) {
+	log := res.logger.Session("run", lager.Data{
+		"path": req.Path,
+		"args": req.Args,
+		"user": req.User,
+	})
+
 	var execPath string
 	if strings.Contains(req.Path, "/") {
 		execPath = req.Path
 	} else {
 		bin, err := exec.LookPath(req.Path)
 		if err != nil {
-			println("path lookup: " + err.Error())
-			respondErr(conn, err)
+			log.Error("failed-to-look-up-path", err)
+			respondErr(res, err)
 			return
 		}
 
@@ -45,8 +76,9 @@ func (mgr *ProcessManager) Run(conn net.Conn, req *ginit.RunRequest) {
 
 	userInfo, err := lookupUser(req.User)
 	if err != nil {
-		println("user lookup: " + err.Error())
-		respondErr(conn, err)
+		log.Error("failed-to-look-up-user", err)
+		respondErr(res, err)
+		return
 	}
 
 	env := req.Env
@@ -89,33 +121,72 @@ func (mgr *ProcessManager) Run(conn net.Conn, req *ginit.RunRequest) {
 	var uid, gid uint32
 	_, err = fmt.Sscanf(userInfo.Uid, "%d", &uid)
 	if err != nil {
-		println("uid parse: " + err.Error())
-		respondErr(conn, err)
+		log.Error("failed-to-parse-uid", err)
+		respondErr(res, err)
+		return
 	}
 
 	_, err = fmt.Sscanf(userInfo.Gid, "%d", &gid)
 	if err != nil {
-		println("gid parse: " + err.Error())
-		respondErr(conn, err)
-	}
-
-	cmd := &exec.Cmd{
-		Path: execPath,
-		Args: append([]string{req.Path}, req.Args...),
-		Dir:  req.Dir,
-		Env:  env,
-		SysProcAttr: &syscall.SysProcAttr{
-			Credential: &syscall.Credential{
-				Uid: uid,
-				Gid: gid,
-			},
-		},
+		log.Error("failed-to-parse-gid", err)
+		respondErr(res, err)
+		return
+	}
+
+	err = validateRestartPolicy(req.Restart)
+	if err != nil {
+		respondErr(res, err)
+		return
+	}
+
+	err = validateProbe(req.Readiness, false)
+	if err != nil {
+		respondErr(res, err)
+		return
+	}
+
+	err = validateProbe(req.Liveness, true)
+	if err != nil {
+		respondErr(res, err)
+		return
+	}
+
+	processID := req.ID
+	if processID == "" {
+		processUUID, err := uuid.NewV4()
+		if err != nil {
+			log.Error("failed-to-generate-uuid", err)
+			respondErr(res, err)
+			return
+		}
+
+		processID = processUUID.String()
+	}
+
+	log = log.WithData(lager.Data{"process-id": processID})
+
+	err = mgr.reserve(processID)
+	if err != nil {
+		log.Info("process-id-unavailable", lager.Data{"error": err.Error()})
+		respondErr(res, err)
+		return
+	}
+
+	defer mgr.release(processID)
+
+	rlimits := map[string]uint64{}
+	for name, val := range mgr.defaultRlimits {
+		rlimits[name] = val
+	}
+
+	for name, val := range req.Limits.ByName() {
+		rlimits[name] = val
 	}
 
 	statusR, statusW, err := os.Pipe()
 	if err != nil {
-		println("create status pipe: " + err.Error())
-		respondErr(conn, err)
+		log.Error("failed-to-create-status-pipe", err)
+		respondErr(res, err)
 		return
 	}
 
@@ -128,8 +199,8 @@ func (mgr *ProcessManager) Run(conn net.Conn, req *ginit.RunRequest) {
 	if req.TTY != nil {
 		pty, tty, err := pty.Open()
 		if err != nil {
-			println("create pty: " + err.Error())
-			respondErr(conn, err)
+			log.Error("failed-to-create-pty", err)
+			respondErr(res, err)
 			return
 		}
 
@@ -144,236 +215,560 @@ func (mgr *ProcessManager) Run(conn net.Conn, req *ginit.RunRequest) {
 		stderrW = tty
 
 		ptyutil.SetWinSize(stdinW, req.TTY.Columns, req.TTY.Rows)
-
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setctty: true,
-			Setsid:  true,
-		}
 	} else {
 		stderrR, stderrW, err = os.Pipe()
 		if err != nil {
-			println("create stderr pipe: " + err.Error())
-			respondErr(conn, err)
+			log.Error("failed-to-create-stderr-pipe", err)
+			respondErr(res, err)
 			return
 		}
 
 		stdinR, stdinW, err = os.Pipe()
 		if err != nil {
-			println("create stdin pipe: " + err.Error())
-			respondErr(conn, err)
+			log.Error("failed-to-create-stdin-pipe", err)
+			respondErr(res, err)
 			return
 		}
 
 		stdoutR, stdoutW, err = os.Pipe()
 		if err != nil {
-			println("create stdout pipe: " + err.Error())
-			respondErr(conn, err)
+			log.Error("failed-to-create-stdout-pipe", err)
+			respondErr(res, err)
 			return
 		}
 	}
 
-	cmd.Stdin = stdinR
-	cmd.Stdout = stdoutW
-	cmd.Stderr = stderrW
+	// outlives the request, for everything that happens to the process later
+	processLog := mgr.logger.Session("process", lager.Data{"process-id": processID})
 
-	err = cmd.Start()
-	if err != nil {
-		println("start: " + err.Error())
-		respondErr(conn, err)
-		return
-	}
+	// with logging enabled, output goes through wshd rather than straight to
+	// clients, so that everything is persisted even when nobody is attached
+	var stdoutTee, stderrTee *outputTee
+
+	if mgr.logDir != "" {
+		err := os.MkdirAll(filepath.Join(mgr.logDir, processID), 0755)
+		if err != nil {
+			log.Error("failed-to-create-log-dir", err)
+			respondErr(res, err)
+			return
+		}
 
-	// close no longer relevant pipe ends
-	// this closes tty 3 times but that's OK
-	stdinR.Close()
-	stdoutW.Close()
-	stderrW.Close()
+		source := stdoutR
+		if req.TTY != nil {
+			// the pty master is still needed for stdin and window size; the
+			// copy gets its own fd so closing it doesn't affect those
+			source, err = dupFile(stdoutR, "pty")
+			if err != nil {
+				log.Error("failed-to-dup-pty", err)
+				respondErr(res, err)
+				return
+			}
+		}
 
-	go func() {
-		err := cmd.Wait()
+		stdoutLog, err := openRotatingLog(processLogPath(mgr.logDir, processID, "stdout"), mgr.logMaxBytes, mgr.logMaxFiles)
 		if err != nil {
-			println("wait: " + err.Error())
+			log.Error("failed-to-open-stdout-log", err)
+
+			if req.TTY != nil {
+				source.Close()
+			}
+
+			respondErr(res, err)
+			return
 		}
 
-		if cmd.ProcessState != nil {
-			fmt.Fprintf(statusW, "%d\n", cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus())
+		stdoutTee = newOutputTee(processLog, source, stdoutLog)
+
+		if stderrR != nil {
+			stderrLog, err := openRotatingLog(processLogPath(mgr.logDir, processID, "stderr"), mgr.logMaxBytes, mgr.logMaxFiles)
+			if err != nil {
+				log.Error("failed-to-open-stderr-log", err)
+				stdoutTee.Close()
+				respondErr(res, err)
+				return
+			}
+
+			stderrTee = newOutputTee(processLog, stderrR, stderrLog)
 		}
-	}()
+	}
 
+	closeTees := func() {
+		for _, tee := range []*outputTee{stdoutTee, stderrTee} {
+			if tee != nil {
+				tee.Close()
+			}
+		}
+	}
+
+	// with a restart policy, the process may be started many times; each
+	// time gets a fresh command, sharing the same streams
+	start := func() (*exec.Cmd, error) {
+		cmd := &exec.Cmd{
+			Path: execPath,
+			Args: append([]string{req.Path}, req.Args...),
+			Dir:  req.Dir,
+			Env:  env,
+
+			Stdin:  stdinR,
+			Stdout: stdoutW,
+			Stderr: stderrW,
+		}
+
+		if req.TTY != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Setctty: true,
+				Setsid:  true,
+			}
+		} else {
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: &syscall.Credential{
+					Uid: uid,
+					Gid: gid,
+				},
+
+				// so that it can be stopped along with its children
+				Setpgid: true,
+			}
+		}
+
+		wrapWithRlimits(cmd, rlimits)
+
+		return cmd, cmd.Start()
+	}
+
+	// the client that runs the process is attached before it starts, so that
+	// it gets all of its output
 	process := &Process{
-		Process: cmd.Process,
+		ID: processID,
+
+		Path: req.Path,
+		Args: req.Args,
+		User: req.User,
+
+		TTY: req.TTY != nil,
 
 		StdinW:  stdinW,
-		StdoutR: stdoutR,
-		StderrR: stderrR,
 		StatusR: statusR,
+
+		stdoutTee: stdoutTee,
+		stderrTee: stderrTee,
+
+		Exited: make(chan struct{}),
+
+		logger: processLog,
+
+		Restart:        req.Restart,
+		stopRestarting: make(chan struct{}),
 	}
 
-	mgr.processesL.Lock()
+	if stdoutTee == nil {
+		process.StdoutR = stdoutR
+	}
 
-	processUUID, err := uuid.NewV4()
+	if stderrTee == nil {
+		process.StderrR = stderrR
+	}
+
+	rights, clientFiles, err := process.Rights()
+	if err != nil {
+		log.Error("failed-to-attach-client", err)
+		closeTees()
+		respondErr(res, err)
+		return
+	}
+
+	defer closeFiles(clientFiles)
+
+	cmd, err := start()
 	if err != nil {
-		println("failed to generate uuid: " + err.Error())
+		log.Error("failed-to-start", err)
+		closeTees()
+		respondErr(res, err)
 		return
 	}
 
-	process.ID = processUUID.String()
+	process.StartedAt = time.Now()
+	process.Started(cmd.Process)
 
+	log.Info("started", lager.Data{"pid": cmd.Process.Pid})
+
+	if stdoutTee != nil {
+		go stdoutTee.run()
+	}
+
+	if stderrTee != nil {
+		go stderrTee.run()
+	}
+
+	probeCredential := &syscall.Credential{
+		Uid: uid,
+		Gid: gid,
+	}
+
+	if req.Readiness != nil {
+		process.readiness = newProber(*req.Readiness, false, probeCredential)
+		go process.readiness.run(process)
+	}
+
+	if req.Liveness != nil {
+		process.liveness = newProber(*req.Liveness, true, probeCredential)
+		go process.liveness.run(process)
+	}
+
+	// the process's ends of its streams stay open until it will no longer be
+	// restarted; this closes tty 3 times but that's OK
+	go supervise(process, cmd, start, statusW, stdinR, stdoutW, stderrW)
+
+	mgr.processesL.Lock()
+	previous, found := mgr.processes[process.ID]
 	mgr.processes[process.ID] = process
 	mgr.processesL.Unlock()
 
-	rights := process.Rights()
+	if found {
+		// the ID is being reused; release the exited process's fds
+		previous.Close()
+	}
 
 	err = respondUnix(
-		conn,
+		res,
 		ginit.Response{
 			Run: &ginit.RunResponse{
 				ProcessID: process.ID,
 				Rights:    rights,
 			},
 		},
-		rights.UnixRights(),
+		rights.FDs(),
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
-func (mgr *ProcessManager) Attach(conn net.Conn, req *ginit.AttachRequest) {
+// reserve claims a process ID for a process that is about to be started.
+// IDs of processes that have exited may be reused.
+func (mgr *ProcessManager) reserve(processID string) error {
+	if processID == "." || processID == ".." || strings.ContainsAny(processID, "/\x00") {
+		return fmt.Errorf("invalid process id: %q", processID)
+	}
+
+	mgr.processesL.Lock()
+	defer mgr.processesL.Unlock()
+
+	if mgr.pending[processID] {
+		return fmt.Errorf("process already running: %s", processID)
+	}
+
+	existing, found := mgr.processes[processID]
+	if found && existing.Running() {
+		return fmt.Errorf("process already running: %s", processID)
+	}
+
+	mgr.pending[processID] = true
+
+	return nil
+}
+
+func (mgr *ProcessManager) release(processID string) {
+	mgr.processesL.Lock()
+	delete(mgr.pending, processID)
+	mgr.processesL.Unlock()
+}
+
+func (mgr *ProcessManager) Attach(res *responder, req *ginit.AttachRequest) {
 	mgr.processesL.Lock()
 	process, found := mgr.processes[req.ProcessID]
 	mgr.processesL.Unlock()
 
 	if !found {
-		respondErr(conn, fmt.Errorf("unknown process: %d", req.ProcessID))
+		respondErr(res, fmt.Errorf("unknown process: %s", req.ProcessID))
+		return
+	}
+
+	rights, clientFiles, err := process.Rights()
+	if err != nil {
+		respondErr(res, err)
 		return
 	}
 
-	rights := process.Rights()
+	defer closeFiles(clientFiles)
 
-	err := respondUnix(
-		conn,
+	err = respondUnix(
+		res,
 		ginit.Response{
 			Attach: &ginit.AttachResponse{
 				Rights: rights,
 			},
 		},
-		rights.UnixRights(),
+		rights.FDs(),
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
-func (mgr *ProcessManager) CreateDir(conn net.Conn, req *ginit.CreateDirRequest) {
+func (mgr *ProcessManager) CreateDir(res *responder, req *ginit.CreateDirRequest) {
 	err := os.MkdirAll(req.Path, 0755)
 	if err != nil {
-		respondErr(conn, err)
+		respondErr(res, err)
 		return
 	}
 
 	err = respondUnix(
-		conn,
+		res,
 		ginit.Response{
 			CreateDir: &ginit.CreateDirResponse{},
 		},
 		nil,
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
-func (mgr *ProcessManager) SetWindowSize(conn net.Conn, req *ginit.SetWindowSizeRequest) {
+func (mgr *ProcessManager) SetWindowSize(res *responder, req *ginit.SetWindowSizeRequest) {
 	mgr.processesL.Lock()
 	process, found := mgr.processes[req.ProcessID]
 	mgr.processesL.Unlock()
 
 	if !found {
-		respondErr(conn, fmt.Errorf("unknown process: %d", req.ProcessID))
+		respondErr(res, fmt.Errorf("unknown process: %s", req.ProcessID))
 		return
 	}
 
 	err := process.SetWindowSize(req.Columns, req.Rows)
 	if err != nil {
-		respondErr(conn, err)
+		respondErr(res, err)
 		return
 	}
 
 	err = respondUnix(
-		conn,
+		res,
 		ginit.Response{
 			SetWindowSize: &ginit.SetWindowSizeResponse{},
 		},
 		nil,
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
-func (mgr *ProcessManager) Signal(conn net.Conn, req *ginit.SignalRequest) {
+func (mgr *ProcessManager) Signal(res *responder, req *ginit.SignalRequest) {
 	mgr.processesL.Lock()
 	process, found := mgr.processes[req.ProcessID]
 	mgr.processesL.Unlock()
 
 	if !found {
-		respondErr(conn, fmt.Errorf("unknown process: %d", req.ProcessID))
+		respondErr(res, fmt.Errorf("unknown process: %s", req.ProcessID))
 		return
 	}
 
 	err := process.Signal(req.Signal)
 	if err != nil {
-		respondErr(conn, err)
+		respondErr(res, err)
 		return
 	}
 
 	err = respondUnix(
-		conn,
+		res,
 		ginit.Response{
 			Signal: &ginit.SignalResponse{},
 		},
 		nil,
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
-func (mgr *ProcessManager) CloseStdin(conn net.Conn, req *ginit.CloseStdinRequest) {
+func (mgr *ProcessManager) CloseStdin(res *responder, req *ginit.CloseStdinRequest) {
 	mgr.processesL.Lock()
 	process, found := mgr.processes[req.ProcessID]
 	mgr.processesL.Unlock()
 
 	if !found {
-		respondErr(conn, fmt.Errorf("unknown process: %d", req.ProcessID))
+		respondErr(res, fmt.Errorf("unknown process: %s", req.ProcessID))
 		return
 	}
 
 	err := process.CloseStdin()
 	if err != nil {
-		respondErr(conn, err)
+		respondErr(res, err)
 		return
 	}
 
 	err = respondUnix(
-		conn,
+		res,
 		ginit.Response{
 			CloseStdin: &ginit.CloseStdinResponse{},
 		},
 		nil,
 	)
 	if err != nil {
-		println("failed to encode response: " + err.Error())
+		res.logger.Error("failed-to-encode-response", err)
 		return
 	}
 }
 
+func (mgr *ProcessManager) ListProcesses(res *responder, req *ginit.ListProcessesRequest) {
+	processes := []ginit.ProcessInfo{}
+
+	mgr.processesL.Lock()
+	if req.ProcessID != "" {
+		process, found := mgr.processes[req.ProcessID]
+		if found {
+			processes = append(processes, process.Info())
+		}
+	} else {
+		for _, process := range mgr.processes {
+			processes = append(processes, process.Info())
+		}
+	}
+	mgr.processesL.Unlock()
+
+	if req.ProcessID != "" && len(processes) == 0 {
+		respondErr(res, fmt.Errorf("unknown process: %s", req.ProcessID))
+		return
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].StartedAt.Before(processes[j].StartedAt)
+	})
+
+	err := respondUnix(
+		res,
+		ginit.Response{
+			ListProcesses: &ginit.ListProcessesResponse{
+				Processes: processes,
+			},
+		},
+		nil,
+	)
+	if err != nil {
+		res.logger.Error("failed-to-encode-response", err)
+		return
+	}
+}
+
+func dupFile(file *os.File, name string) (*os.File, error) {
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	syscall.CloseOnExec(fd)
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (mgr *ProcessManager) Stop(res *responder, req *ginit.StopRequest) {
+	mgr.processesL.Lock()
+	running := []*Process{}
+	for _, process := range mgr.processes {
+		if process.Running() {
+			running = append(running, process)
+		}
+	}
+	mgr.processesL.Unlock()
+
+	log := res.logger.Session("stop", lager.Data{
+		"kill":      req.Kill,
+		"processes": len(running),
+	})
+
+	log.Info("starting")
+
+	if !req.Kill {
+		for _, process := range running {
+			err := process.Signal(syscall.SIGTERM)
+			if err != nil {
+				log.Error("failed-to-terminate", err, lager.Data{"process-id": process.ID})
+			}
+		}
+
+		if !waitForExit(running, req.GracePeriod) {
+			log.Info("grace-period-expired", lager.Data{"grace-period": req.GracePeriod.String()})
+		}
+	}
+
+	for _, process := range running {
+		if process.Running() {
+			err := process.Signal(syscall.SIGKILL)
+			if err != nil {
+				log.Error("failed-to-kill", err, lager.Data{"process-id": process.ID})
+			}
+		}
+	}
+
+	for _, process := range running {
+		<-process.Exited
+	}
+
+	log.Info("stopped")
+
+	err := respondUnix(
+		res,
+		ginit.Response{
+			Stop: &ginit.StopResponse{},
+		},
+		nil,
+	)
+	if err != nil {
+		res.logger.Error("failed-to-encode-response", err)
+		return
+	}
+}
+
+// waitForExit returns whether all of the processes exited before the timeout.
+func waitForExit(processes []*Process, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	for _, process := range processes {
+		select {
+		case <-process.Exited:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupCredential returns the credential to run as the given user, which
+// defaults to root.
+func lookupCredential(name string) (*syscall.Credential, error) {
+	if name == "" {
+		name = "root"
+	}
+
+	userInfo, err := lookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var uid, gid uint32
+
+	_, err = fmt.Sscanf(userInfo.Uid, "%d", &uid)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Sscanf(userInfo.Gid, "%d", &gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{
+		Uid: uid,
+		Gid: gid,
+	}, nil
+}
+
 func lookupUser(name string) (*user.User, error) {
 	file, err := ioutil.ReadFile("/etc/passwd")
 	if err != nil {
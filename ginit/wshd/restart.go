@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+const (
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+)
+
+func validateRestartPolicy(policy ginit.RestartPolicy) error {
+	switch policy.Policy {
+	case "", ginit.RestartNever, ginit.RestartOnFailure, ginit.RestartAlways:
+	default:
+		return fmt.Errorf("unknown restart policy: %s", policy.Policy)
+	}
+
+	if policy.Backoff < 0 || policy.MaxBackoff < 0 || policy.MaxRestarts < 0 {
+		return fmt.Errorf("invalid restart policy: negative backoff or max restarts")
+	}
+
+	return nil
+}
+
+// supervise waits for a process to exit, restarting it for as long as its
+// restart policy allows, and then reports its final exit status. The
+// process's ends of its streams are closed once it has exited for good, so
+// that clients see EOF only then.
+func supervise(process *Process, cmd *exec.Cmd, start func() (*exec.Cmd, error), statusW *os.File, streams ...*os.File) {
+	var status int
+
+	for {
+		var signal syscall.Signal
+		status, signal = waitForStatus(process.logger, cmd)
+
+		process.Died(signal)
+
+		if !shouldRestart(process.Restart, status) {
+			break
+		}
+
+		if process.restartsStopped() {
+			break
+		}
+
+		restarts := process.Restarts()
+
+		if process.Restart.MaxRestarts > 0 && restarts >= process.Restart.MaxRestarts {
+			process.logger.Info("reached-max-restarts", lager.Data{
+				"exit-status": status,
+				"restarts":    restarts,
+			})
+			break
+		}
+
+		process.Restarting()
+
+		delay := restartBackoff(process.Restart, restarts)
+
+		process.logger.Info("restarting", lager.Data{
+			"exit-status": status,
+			"restarts":    restarts,
+			"backoff":     delay.String(),
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-process.stopRestarting:
+		}
+
+		if process.restartsStopped() {
+			process.logger.Info("restart-stopped")
+			break
+		}
+
+		next, err := start()
+		if err != nil {
+			process.logger.Error("failed-to-restart", err)
+			break
+		}
+
+		process.Started(next.Process)
+
+		process.logger.Info("restarted", lager.Data{"pid": next.Process.Pid})
+
+		// a signal meant to stop the process may have been sent after the
+		// backoff but before the new incarnation was recorded
+		if process.restartsStopped() {
+			process.signalIncarnation(next.Process, syscall.SIGKILL)
+		}
+
+		cmd = next
+	}
+
+	for _, stream := range streams {
+		stream.Close()
+	}
+
+	process.logger.Info("exited", lager.Data{
+		"exit-status": status,
+		"restarts":    process.Restarts(),
+	})
+
+	fmt.Fprintf(statusW, "%d\n", status)
+
+	process.Exit(status)
+}
+
+// waitForStatus returns the exit status of the command, along with the signal
+// that killed it, if any.
+func waitForStatus(logger lager.Logger, cmd *exec.Cmd) (int, syscall.Signal) {
+	err := cmd.Wait()
+	if err != nil {
+		if _, exited := err.(*exec.ExitError); !exited {
+			logger.Error("failed-to-wait", err)
+		}
+	}
+
+	if cmd.ProcessState == nil {
+		return -1, 0
+	}
+
+	waitStatus := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if waitStatus.Signaled() {
+		return waitStatus.ExitStatus(), waitStatus.Signal()
+	}
+
+	return waitStatus.ExitStatus(), 0
+}
+
+// shouldRestart reports whether the policy calls for a restart after the
+// given exit status; a process killed by a signal has a status of -1.
+func shouldRestart(policy ginit.RestartPolicy, status int) bool {
+	switch policy.Policy {
+	case ginit.RestartAlways:
+		return true
+	case ginit.RestartOnFailure:
+		return status != 0
+	default:
+		return false
+	}
+}
+
+// restartBackoff returns the delay before a restart, given the number of
+// restarts before it.
+func restartBackoff(policy ginit.RestartPolicy, restarts int) time.Duration {
+	backoff := policy.Backoff
+	if backoff == 0 {
+		backoff = defaultRestartBackoff
+	}
+
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxRestartBackoff
+	}
+
+	for i := 0; i < restarts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	return backoff
+}
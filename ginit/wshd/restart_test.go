@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vito/garden-systemd/ginit"
+)
+
+func TestShouldRestart(t *testing.T) {
+	for _, example := range []struct {
+		policy   string
+		status   int
+		expected bool
+	}{
+		{"", 0, false},
+		{"", 1, false},
+		{ginit.RestartNever, 1, false},
+		{ginit.RestartOnFailure, 0, false},
+		{ginit.RestartOnFailure, 1, true},
+		{ginit.RestartOnFailure, 128 + 9, true},
+		{ginit.RestartAlways, 0, true},
+		{ginit.RestartAlways, 1, true},
+	} {
+		restart := shouldRestart(ginit.RestartPolicy{Policy: example.policy}, example.status)
+		if restart != example.expected {
+			t.Errorf("policy %q, status %d: expected %v, got %v", example.policy, example.status, example.expected, restart)
+		}
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	for _, example := range []struct {
+		backoff    time.Duration
+		maxBackoff time.Duration
+		restarts   int
+		expected   time.Duration
+	}{
+		{0, 0, 0, time.Second},
+		{0, 0, 1, 2 * time.Second},
+		{0, 0, 5, 32 * time.Second},
+		{0, 0, 6, time.Minute},
+		{0, 0, 1000, time.Minute},
+		{100 * time.Millisecond, 0, 3, 800 * time.Millisecond},
+		{100 * time.Millisecond, time.Second, 4, time.Second},
+		{time.Second, 3 * time.Second, 1, 2 * time.Second},
+		{time.Second, 3 * time.Second, 2, 3 * time.Second},
+		// a backoff beyond the max is capped from the start
+		{time.Hour, time.Minute, 0, time.Minute},
+	} {
+		policy := ginit.RestartPolicy{
+			Policy:     ginit.RestartAlways,
+			Backoff:    example.backoff,
+			MaxBackoff: example.maxBackoff,
+		}
+
+		backoff := restartBackoff(policy, example.restarts)
+		if backoff != example.expected {
+			t.Errorf("%#v after %d restarts: expected %s, got %s", policy, example.restarts, example.expected, backoff)
+		}
+	}
+}
+
+func TestValidateRestartPolicy(t *testing.T) {
+	valid := []ginit.RestartPolicy{
+		{},
+		{Policy: ginit.RestartOnFailure, Backoff: time.Second, MaxRestarts: 3},
+		{Policy: ginit.RestartAlways, MaxBackoff: time.Minute},
+	}
+
+	for _, policy := range valid {
+		err := validateRestartPolicy(policy)
+		if err != nil {
+			t.Errorf("expected %#v to be valid, got %s", policy, err)
+		}
+	}
+
+	invalid := []ginit.RestartPolicy{
+		{Policy: "sometimes"},
+		{Policy: ginit.RestartAlways, Backoff: -time.Second},
+		{Policy: ginit.RestartAlways, MaxBackoff: -time.Second},
+		{Policy: ginit.RestartAlways, MaxRestarts: -1},
+	}
+
+	for _, policy := range invalid {
+		err := validateRestartPolicy(policy)
+		if err == nil {
+			t.Errorf("expected %#v to be invalid", policy)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// re-executing wshd with this as its first argument applies resource limits
+// and credentials and then execs the real process; Go gives us no way to run
+// setrlimit in the child between fork and exec
+const rlimitExecCommand = "rlimit-exec"
+
+// from package unix, as not all of them are defined by package syscall
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// wrapWithRlimits rewrites cmd to go through the rlimit-exec shim. The shim
+// starts as root so that hard limits may be raised, and then drops to the
+// credentials the command was configured with.
+func wrapWithRlimits(cmd *exec.Cmd, byName map[string]uint64) {
+	if len(byName) == 0 {
+		return
+	}
+
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	args := []string{"wshd", rlimitExecCommand}
+
+	for _, name := range names {
+		args = append(args, "-rlimit", name+"="+strconv.FormatUint(byName[name], 10))
+	}
+
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		args = append(
+			args,
+			"-uid", strconv.FormatUint(uint64(cmd.SysProcAttr.Credential.Uid), 10),
+			"-gid", strconv.FormatUint(uint64(cmd.SysProcAttr.Credential.Gid), 10),
+		)
+
+		cmd.SysProcAttr.Credential = nil
+	}
+
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args...)
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = args
+}
+
+type rlimitFlags map[string]uint64
+
+func (f rlimitFlags) String() string {
+	pairs := []string{}
+	for name, val := range f {
+		pairs = append(pairs, name+"="+strconv.FormatUint(val, 10))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (f rlimitFlags) Set(arg string) error {
+	segs := strings.SplitN(arg, "=", 2)
+	if len(segs) != 2 {
+		return fmt.Errorf("invalid rlimit (expected name=value): %s", arg)
+	}
+
+	if _, found := rlimitResources[segs[0]]; !found {
+		return fmt.Errorf("unknown rlimit: %s", segs[0])
+	}
+
+	val, err := strconv.ParseUint(segs[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid rlimit value for %s: %s", segs[0], err)
+	}
+
+	f[segs[0]] = val
+
+	return nil
+}
+
+// rlimitExec is the entrypoint of the shim; it never returns.
+func rlimitExec(args []string) {
+	flags := flag.NewFlagSet(rlimitExecCommand, flag.ExitOnError)
+
+	rlimits := rlimitFlags{}
+	flags.Var(rlimits, "rlimit", "resource limit to apply, as name=value")
+
+	uid := flags.Int("uid", -1, "user to run as")
+	gid := flags.Int("gid", -1, "group to run as")
+
+	flags.Parse(args)
+
+	argv := flags.Args()
+	if len(argv) < 2 {
+		fail("rlimit-exec: no command given")
+	}
+
+	for name, val := range rlimits {
+		err := syscall.Setrlimit(rlimitResources[name], &syscall.Rlimit{
+			Cur: val,
+			Max: val,
+		})
+		if err != nil {
+			fail("rlimit-exec: set rlimit " + name + ": " + err.Error())
+		}
+	}
+
+	if *gid >= 0 {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			fail("rlimit-exec: setgroups: " + err.Error())
+		}
+
+		if err := syscall.Setgid(*gid); err != nil {
+			fail("rlimit-exec: setgid: " + err.Error())
+		}
+	}
+
+	if *uid >= 0 {
+		if err := syscall.Setuid(*uid); err != nil {
+			fail("rlimit-exec: setuid: " + err.Error())
+		}
+	}
+
+	err := syscall.Exec(argv[0], argv[1:], os.Environ())
+	fail("rlimit-exec: exec: " + err.Error())
+}
+
+func fail(msg string) {
+	println(msg)
+	os.Exit(127)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+// re-executing wshd with these as its first argument extracts a tar stream
+// from stdin into the given directory, or writes a tar stream of the given
+// path to stdout; they are run as the requested user, so that files are
+// created and read with their permissions
+const (
+	streamInCommand  = "stream-in"
+	streamOutCommand = "stream-out"
+)
+
+func (mgr *ProcessManager) StreamIn(res *responder, req *ginit.StreamInRequest, fds []int) {
+	if len(fds) != 1 {
+		closeFDs(fds)
+		respondErr(res, fmt.Errorf("stream in: expected 1 fd, got %d", len(fds)))
+		return
+	}
+
+	tarStream := os.NewFile(uintptr(fds[0]), "tar")
+	defer tarStream.Close()
+
+	log := res.logger.Session("stream-in", lager.Data{
+		"path": req.Path,
+		"user": req.User,
+	})
+
+	credential, err := lookupCredential(req.User)
+	if err != nil {
+		log.Error("failed-to-look-up-user", err)
+		respondErr(res, err)
+		return
+	}
+
+	started := time.Now()
+
+	errBuf := new(bytes.Buffer)
+
+	cmd := exec.Command("/proc/self/exe", streamInCommand, req.Path)
+	cmd.Stdin = tarStream
+	cmd.Stderr = errBuf
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: credential,
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		log.Error("failed-to-extract", err, lager.Data{
+			"stderr":   errBuf.String(),
+			"duration": time.Since(started).String(),
+		})
+
+		respondErr(res, fmt.Errorf("stream in: %s: %s", err, strings.TrimSpace(errBuf.String())))
+		return
+	}
+
+	log.Info("streamed", lager.Data{"duration": time.Since(started).String()})
+
+	err = respondUnix(
+		res,
+		ginit.Response{
+			StreamIn: &ginit.StreamInResponse{},
+		},
+		nil,
+	)
+	if err != nil {
+		res.logger.Error("failed-to-encode-response", err)
+		return
+	}
+}
+
+func (mgr *ProcessManager) StreamOut(res *responder, req *ginit.StreamOutRequest, fds []int) {
+	if len(fds) != 2 {
+		closeFDs(fds)
+		respondErr(res, fmt.Errorf("stream out: expected 2 fds, got %d", len(fds)))
+		return
+	}
+
+	tarStream := os.NewFile(uintptr(fds[0]), "tar")
+	statusW := os.NewFile(uintptr(fds[1]), "status")
+
+	log := res.logger.Session("stream-out", lager.Data{
+		"path": req.Path,
+		"user": req.User,
+	})
+
+	credential, err := lookupCredential(req.User)
+	if err != nil {
+		log.Error("failed-to-look-up-user", err)
+		tarStream.Close()
+		statusW.Close()
+		respondErr(res, err)
+		return
+	}
+
+	errBuf := new(bytes.Buffer)
+
+	cmd := exec.Command("/proc/self/exe", streamOutCommand, req.Path)
+	cmd.Stdout = tarStream
+	cmd.Stderr = errBuf
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: credential,
+	}
+
+	err = cmd.Start()
+
+	// the child has its own copy; the reader sees EOF once it exits
+	tarStream.Close()
+
+	if err != nil {
+		log.Error("failed-to-start", err)
+		statusW.Close()
+		respondErr(res, fmt.Errorf("stream out: %s", err))
+		return
+	}
+
+	started := time.Now()
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Error("failed-to-archive", err, lager.Data{
+				"stderr":   errBuf.String(),
+				"duration": time.Since(started).String(),
+			})
+
+			fmt.Fprintf(statusW, "stream out: %s: %s\n", err, strings.TrimSpace(errBuf.String()))
+		} else {
+			log.Info("streamed", lager.Data{"duration": time.Since(started).String()})
+		}
+
+		statusW.Close()
+	}()
+
+	err = respondUnix(
+		res,
+		ginit.Response{
+			StreamOut: &ginit.StreamOutResponse{},
+		},
+		nil,
+	)
+	if err != nil {
+		res.logger.Error("failed-to-encode-response", err)
+		return
+	}
+}
+
+// streamInExec is the entrypoint of the stream-in command; it never returns.
+func streamInExec(args []string) {
+	if len(args) != 1 {
+		fail("stream-in: expected destination")
+	}
+
+	err := extractTar(os.Stdin, args[0])
+	if err != nil {
+		fail(err.Error())
+	}
+
+	os.Exit(0)
+}
+
+// extractTar extracts a tar stream into dest, creating it if needed. File
+// ownership from the stream is only preserved when running as root;
+// otherwise everything is owned by the current user.
+func extractTar(stream io.Reader, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	preserveOwnership := os.Getuid() == 0
+
+	// directories get their modes and times once everything is extracted,
+	// so that read-only ones can still be filled, and their times stick
+	dirs := []*tar.Header{}
+
+	tarReader := tar.NewReader(stream)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		target, err := resolveBeneath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+
+		err = extractEntry(tarReader, header, dest, target)
+		if err != nil {
+			return fmt.Errorf("extract %s: %s", header.Name, err)
+		}
+
+		if preserveOwnership {
+			err := os.Lchown(target, header.Uid, header.Gid)
+			if err != nil {
+				return fmt.Errorf("chown %s: %s", header.Name, err)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+		case tar.TypeDir:
+			dirs = append(dirs, header)
+		default:
+			err := setModeAndTimes(target, header)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// a later entry may have replaced a parent with a symlink
+		target, err := resolveBeneath(dest, dirs[i].Name)
+		if err != nil {
+			return err
+		}
+
+		err = setModeAndTimes(target, dirs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveBeneath returns the path of an entry within dest, refusing entries
+// that would lead outside of it, whether by their name or through a symlink
+// extracted earlier (e.g. a -> /etc followed by a/passwd).
+func resolveBeneath(dest string, name string) (string, error) {
+	dest = filepath.Clean(dest)
+
+	target := filepath.Join(dest, name)
+	if target == dest {
+		return target, nil
+	}
+
+	if !strings.HasPrefix(target, dest+"/") {
+		return "", fmt.Errorf("refusing to extract outside of destination: %s", name)
+	}
+
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil {
+		return "", err
+	}
+
+	if rel == "." {
+		return target, nil
+	}
+
+	parent := dest
+	for _, component := range strings.Split(rel, "/") {
+		parent = filepath.Join(parent, component)
+
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			// the rest is created as directories
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract through a symlink: %s", name)
+		}
+	}
+
+	return target, nil
+}
+
+// removeSymlink removes whatever is at target if it is a symlink, so that it
+// is replaced rather than followed.
+func removeSymlink(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	return os.Remove(target)
+}
+
+// setModeAndTimes must be called after chown, which clears setuid and
+// setgid bits.
+func setModeAndTimes(target string, header *tar.Header) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+
+	// chmod and chtimes would follow it
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to set mode through a symlink: %s", header.Name)
+	}
+
+	err = os.Chmod(target, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return fmt.Errorf("chmod %s: %s", header.Name, err)
+	}
+
+	err = os.Chtimes(target, header.ModTime, header.ModTime)
+	if err != nil {
+		return fmt.Errorf("set times of %s: %s", header.Name, err)
+	}
+
+	return nil
+}
+
+func extractEntry(tarReader *tar.Reader, header *tar.Header, dest string, target string) error {
+	if header.Typeflag != tar.TypeDir {
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		err := removeSymlink(target)
+		if err != nil {
+			return err
+		}
+
+		return os.MkdirAll(target, 0755)
+
+	case tar.TypeReg, tar.TypeRegA:
+		err := removeSymlink(target)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, tarReader)
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		return file.Close()
+
+	case tar.TypeSymlink:
+		err := os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return os.Symlink(header.Linkname, target)
+
+	case tar.TypeLink:
+		err := os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		source, err := resolveBeneath(dest, header.Linkname)
+		if err != nil {
+			return err
+		}
+
+		return os.Link(source, target)
+
+	case tar.TypeFifo:
+		return syscall.Mkfifo(target, 0600)
+
+	case tar.TypeChar, tar.TypeBlock:
+		mode := uint32(syscall.S_IFCHR)
+		if header.Typeflag == tar.TypeBlock {
+			mode = syscall.S_IFBLK
+		}
+
+		return syscall.Mknod(target, mode|0600, mkdev(header.Devmajor, header.Devminor))
+
+	default:
+		return errors.New("unsupported file type")
+	}
+}
+
+// mkdev encodes a device number the way glibc's makedev does.
+func mkdev(major, minor int64) int {
+	return int((major&0xfff)<<8 | (minor & 0xff) | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
+
+// streamOutExec is the entrypoint of the stream-out command; it never
+// returns.
+func streamOutExec(args []string) {
+	if len(args) != 1 {
+		fail("stream-out: expected source")
+	}
+
+	err := writeTar(os.Stdout, args[0])
+	if err != nil {
+		fail(err.Error())
+	}
+
+	os.Exit(0)
+}
+
+// writeTar writes a tar stream of src to the writer. As with tar(1), the
+// entries are named relative to src's parent directory, so that src itself
+// is the top-level entry; a trailing slash makes them relative to src
+// instead, so that only its contents are included.
+func writeTar(stream io.Writer, src string) error {
+	var base, root string
+	if strings.HasSuffix(src, "/") {
+		base = src
+		root = "."
+	} else {
+		base = filepath.Dir(src)
+		root = filepath.Base(src)
+	}
+
+	tarWriter := tar.NewWriter(stream)
+
+	err := filepath.Walk(filepath.Join(base, root), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSocket != 0 {
+			// not representable in a tar stream
+			return nil
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		if root == "." && rel != "." {
+			rel = "./" + rel
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		_, err = io.CopyN(tarWriter, file, header.Size)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+func tarStream(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	stream := new(bytes.Buffer)
+
+	tarWriter := tar.NewWriter(stream)
+
+	for _, entry := range entries {
+		header := entry.header
+		header.Size = int64(len(entry.content))
+
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+
+		if header.ModTime.IsZero() {
+			header.ModTime = time.Now()
+		}
+
+		err := tarWriter.WriteHeader(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tarWriter.Write([]byte(entry.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tarWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stream
+}
+
+// extractDirs returns a destination to extract into and a dir beside it
+// that must not be written to.
+func extractDirs(t *testing.T) (string, string, func()) {
+	tmpDir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(tmpDir, "dest")
+	outside := filepath.Join(tmpDir, "outside")
+
+	for _, dir := range []string{dest, outside} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dest, outside, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestExtractTar(t *testing.T) {
+	dest, _, cleanup := extractDirs(t)
+	defer cleanup()
+
+	modTime := time.Unix(1234567890, 0)
+
+	err := extractTar(tarStream(t,
+		tarEntry{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: modTime}},
+		tarEntry{header: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0640}, content: "hello"},
+		tarEntry{header: tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"}},
+		tarEntry{header: tar.Header{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file", Mode: 0640}},
+		tarEntry{header: tar.Header{Name: "implied/file", Typeflag: tar.TypeReg}, content: "implied"},
+	), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "dir", "file"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("expected dir/file to be extracted, got %q (%v)", content, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "dir", "file"))
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected dir/file to have mode 0640, got %v (%v)", info.Mode(), err)
+	}
+
+	info, err = os.Stat(filepath.Join(dest, "dir"))
+	if err != nil || info.Mode().Perm() != 0700 || !info.ModTime().Equal(modTime) {
+		t.Errorf("expected dir's mode and time to be set after its contents, got %v %s (%v)", info.Mode(), info.ModTime(), err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dest, "dir", "link"))
+	if err != nil || link != "file" {
+		t.Errorf("expected dir/link to point to file, got %q (%v)", link, err)
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dest, "dir", "hardlink"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("expected dir/hardlink to be linked to dir/file, got %q (%v)", content, err)
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dest, "implied", "file"))
+	if err != nil || string(content) != "implied" {
+		t.Errorf("expected implied/file to be extracted, got %q (%v)", content, err)
+	}
+}
+
+func TestExtractTarRefusesToEscape(t *testing.T) {
+	for _, example := range []struct {
+		description string
+		entries     []tarEntry
+	}{
+		{
+			"a path leading outside",
+			[]tarEntry{
+				{header: tar.Header{Name: "../outside/secret", Typeflag: tar.TypeReg}, content: "overwritten"},
+			},
+		},
+		{
+			"a file through a symlink",
+			[]tarEntry{
+				{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+				{header: tar.Header{Name: "a/secret", Typeflag: tar.TypeReg}, content: "overwritten"},
+			},
+		},
+		{
+			"a file through an absolute symlink",
+			[]tarEntry{
+				{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "/"}},
+				{header: tar.Header{Name: "a/tmp/escaped", Typeflag: tar.TypeReg}, content: "escaped"},
+			},
+		},
+		{
+			"a hard link to a file outside",
+			[]tarEntry{
+				{header: tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}},
+			},
+		},
+		{
+			"a hard link through a symlink",
+			[]tarEntry{
+				{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+				{header: tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "a/secret"}},
+			},
+		},
+		{
+			"a mode change through a symlink",
+			[]tarEntry{
+				{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777}},
+				{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+			},
+		},
+	} {
+		dest, outside, cleanup := extractDirs(t)
+
+		outsideInfo, err := os.Stat(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = extractTar(tarStream(t, example.entries...), dest)
+		if err == nil {
+			t.Errorf("%s: expected an error", example.description)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(outside, "secret"))
+		if err != nil || string(content) != "secret" {
+			t.Errorf("%s: expected the file outside to be left alone, got %q (%v)", example.description, content, err)
+		}
+
+		info, err := os.Stat(filepath.Join(outside, "secret"))
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected the mode of the file outside to be left alone, got %v (%v)", example.description, info.Mode(), err)
+		}
+
+		info, err = os.Stat(outside)
+		if err != nil || info.Mode() != outsideInfo.Mode() {
+			t.Errorf("%s: expected the mode of the dir outside to be left alone, got %v (%v)", example.description, info.Mode(), err)
+		}
+
+		_, err = os.Lstat(filepath.Join(dest, "stolen"))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected no link to the file outside to be made", example.description)
+		}
+
+		cleanup()
+	}
+
+	_, err := os.Stat("/tmp/escaped")
+	if !os.IsNotExist(err) {
+		os.Remove("/tmp/escaped")
+		t.Error("expected nothing to be written through an absolute symlink")
+	}
+}
+
+func TestExtractTarReplacesSymlinks(t *testing.T) {
+	dest, outside, cleanup := extractDirs(t)
+	defer cleanup()
+
+	err := extractTar(tarStream(t,
+		tarEntry{header: tar.Header{Name: "file", Typeflag: tar.TypeSymlink, Linkname: "../outside/secret"}},
+		tarEntry{header: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "replaced"},
+		tarEntry{header: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		tarEntry{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir}},
+	), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "file"))
+	if err != nil || string(content) != "replaced" {
+		t.Errorf("expected the symlink to be replaced with a file, got %q (%v)", content, err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dest, "dir"))
+	if err != nil || !info.IsDir() {
+		t.Errorf("expected the symlink to be replaced with a dir, got %v (%v)", info, err)
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(content) != "secret" {
+		t.Errorf("expected the file outside to be left alone, got %q (%v)", content, err)
+	}
+}
+
+func TestWriteTarRoundTrips(t *testing.T) {
+	src, _, cleanup := extractDirs(t)
+	defer cleanup()
+
+	err := os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, example := range []struct {
+		src      string
+		expected string
+	}{
+		{src, "dest/dir/file"},
+		{src + "/", "dir/file"},
+	} {
+		dest, _, cleanupDest := extractDirs(t)
+
+		stream := new(bytes.Buffer)
+
+		err := writeTar(stream, example.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = extractTar(stream, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dest, example.expected))
+		if err != nil || string(content) != "hello" {
+			t.Errorf("%s: expected %s to be extracted, got %q (%v)", example.src, example.expected, content, err)
+		}
+
+		cleanupDest()
+	}
+}
@@ -1,138 +1,336 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"syscall"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/vito/garden-systemd/ginit"
 )
 
+var containerID = flag.String(
+	"containerID",
+	"",
+	"ID of the container, included in every log line",
+)
+
 var runDir = flag.String(
 	"run",
 	"",
 	"directory in which to place the listening socket",
 )
 
+var logDir = flag.String(
+	"logs",
+	"",
+	"directory in which to persist process output (disabled if empty)",
+)
+
+var logMaxBytes = flag.Int64(
+	"logMaxBytes",
+	10*1024*1024,
+	"size at which a process's output log is rotated",
+)
+
+var logMaxFiles = flag.Int(
+	"logMaxFiles",
+	5,
+	"number of output log files to keep per stream, including the current one",
+)
+
+var defaultRlimits = rlimitFlags{}
+
+func init() {
+	flag.Var(
+		defaultRlimits,
+		"rlimit",
+		"default resource limit for all processes, as name=value (may be given multiple times)",
+	)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == rlimitExecCommand {
+		rlimitExec(os.Args[2:])
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == streamInCommand {
+		streamInExec(os.Args[2:])
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == streamOutCommand {
+		streamOutExec(os.Args[2:])
+	}
+
 	flag.Parse()
 
+	// stderr ends up in the journal (or the chroot runtime's output.log), as
+	// one JSON object per line
+	logger := lager.NewLogger("wshd")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.DEBUG))
+
+	if *containerID != "" {
+		logger = logger.WithData(lager.Data{"container-id": *containerID})
+	}
+
 	if len(*runDir) == 0 {
-		println("must specify -run")
-		os.Exit(1)
+		logger.Fatal("missing-run-dir", errors.New("must specify -run"))
 	}
 
 	socketPath := filepath.Join(*runDir, "wshd.sock")
 
 	err := os.RemoveAll(socketPath)
 	if err != nil {
-		println("remove existing socket: " + err.Error())
-		os.Exit(1)
+		logger.Fatal("failed-to-remove-existing-socket", err)
 	}
 
 	sock, err := net.Listen("unix", socketPath)
 	if err != nil {
-		println("listen: " + err.Error())
-		os.Exit(1)
+		logger.Fatal("failed-to-listen", err)
 	}
 
 	err = syscall.Unmount(*runDir, syscall.MNT_DETACH)
 	if err != nil {
-		println("umount run dir: " + err.Error())
-		os.Exit(1)
+		logger.Fatal("failed-to-unmount-run-dir", err)
 	}
 
 	err = os.RemoveAll(*runDir)
 	if err != nil {
-		println("cleanup run dir: " + err.Error())
-		os.Exit(1)
+		logger.Fatal("failed-to-cleanup-run-dir", err)
 	}
 
-	mgr := newProcessManager()
+	err = notifyReady()
+	if err != nil {
+		logger.Fatal("failed-to-notify-ready", err)
+	}
+
+	logger.Info("started", lager.Data{"pid": os.Getpid()})
+
+	mgr := newProcessManager(logger, *logDir, *logMaxBytes, *logMaxFiles, defaultRlimits)
 
 	for {
 		conn, err := sock.Accept()
 		if err != nil {
-			println("accept: " + err.Error())
-			os.Exit(1)
+			logger.Fatal("failed-to-accept", err)
 		}
 
 		go handleConnection(mgr, conn)
 	}
 }
 
+var capabilities = []string{
+	ginit.CapabilityRun,
+	ginit.CapabilityAttach,
+	ginit.CapabilitySignal,
+	ginit.CapabilityCreateDir,
+	ginit.CapabilitySetWindowSize,
+	ginit.CapabilityCloseStdin,
+	ginit.CapabilityStop,
+	ginit.CapabilityListProcesses,
+	ginit.CapabilityStreamIn,
+	ginit.CapabilityStreamOut,
+}
+
+// responder sends the response to a single request.
+type responder struct {
+	frames    *ginit.FrameConn
+	requestID uint64
+
+	// carries the connection and request ID
+	logger lager.Logger
+}
+
 func handleConnection(mgr *ProcessManager, conn net.Conn) {
-	dec := gob.NewDecoder(conn)
+	log := mgr.logger.Session("connection")
+
+	frames := ginit.NewFrameConn(conn.(*net.UnixConn), ginit.GobCodec)
+	defer frames.Close()
+
+	payload, fds, err := frames.ReadFrame()
+	if err != nil {
+		if err != io.EOF {
+			log.Error("failed-to-read-hello", err)
+		}
+
+		return
+	}
+
+	closeFDs(fds)
+
+	// the client picks the codec; everything after the Hello uses it too
+	codec := ginit.DetectCodec(payload)
+	frames.SetCodec(codec)
+
+	var hello ginit.Hello
+	err = codec.Unmarshal(payload, &hello)
+	if err != nil {
+		log.Error("failed-to-decode-hello", err, lager.Data{"codec": codec.Name()})
+		return
+	}
+
+	version := ginit.ProtocolVersion
+	if hello.MaxVersion < version {
+		version = hello.MaxVersion
+	}
+
+	if version < hello.MinVersion || version < ginit.MinProtocolVersion {
+		msg := fmt.Sprintf(
+			"no common protocol version (client: %d-%d, server: %d-%d)",
+			hello.MinVersion,
+			hello.MaxVersion,
+			ginit.MinProtocolVersion,
+			ginit.ProtocolVersion,
+		)
+
+		log.Info("handshake-failed", lager.Data{"error": msg})
+
+		err := frames.WriteMessage(ginit.HelloResponse{Error: &msg}, nil)
+		if err != nil {
+			log.Error("failed-to-encode-hello-response", err)
+		}
+
+		return
+	}
+
+	err = frames.WriteMessage(ginit.HelloResponse{
+		Version:      version,
+		Capabilities: capabilities,
+	}, nil)
+	if err != nil {
+		log.Error("failed-to-encode-hello-response", err)
+		return
+	}
+
+	log.Debug("connected", lager.Data{
+		"codec":   codec.Name(),
+		"version": version,
+	})
 
 	for {
 		var request ginit.Request
-		err := dec.Decode(&request)
+		fds, err := frames.ReadMessage(&request)
 		if err != nil {
 			if err != io.EOF {
-				println("decode: " + err.Error())
+				log.Error("failed-to-decode-request", err)
 			}
 
 			return
 		}
 
-		if request.Run != nil {
-			println("handling run")
-			mgr.Run(conn, request.Run)
-		}
+		res := &responder{
+			frames:    frames,
+			requestID: request.ID,
 
-		if request.Attach != nil {
-			println("handling attach")
-			mgr.Attach(conn, request.Attach)
+			logger: log.WithData(lager.Data{"request-id": request.ID}),
 		}
 
-		if request.CreateDir != nil {
-			println("handling create dir")
-			mgr.CreateDir(conn, request.CreateDir)
-		}
+		go handleRequest(mgr, res, request, fds)
+	}
+}
 
-		if request.SetWindowSize != nil {
-			println("handling set window size")
-			mgr.SetWindowSize(conn, request.SetWindowSize)
-		}
+// handleRequest takes ownership of any fds sent with the request.
+func handleRequest(mgr *ProcessManager, res *responder, request ginit.Request, fds []int) {
+	if request.StreamIn == nil && request.StreamOut == nil {
+		// only streaming carries fds
+		closeFDs(fds)
+		fds = nil
+	}
 
-		if request.Signal != nil {
-			println("handling signal")
-			mgr.Signal(conn, request.Signal)
+	set := 0
+	for _, present := range []bool{
+		request.Run != nil,
+		request.Attach != nil,
+		request.CreateDir != nil,
+		request.SetWindowSize != nil,
+		request.Signal != nil,
+		request.CloseStdin != nil,
+		request.Stop != nil,
+		request.ListProcesses != nil,
+		request.StreamIn != nil,
+		request.StreamOut != nil,
+	} {
+		if present {
+			set++
 		}
+	}
 
-		if request.CloseStdin != nil {
-			println("handling close stdin")
-			mgr.CloseStdin(conn, request.CloseStdin)
-		}
+	if set > 1 {
+		closeFDs(fds)
+		respondErr(res, fmt.Errorf("malformed request: %d requests in one message", set))
+		return
+	}
+
+	switch {
+	case request.Run != nil:
+		res.logger.Debug("handling-run")
+		mgr.Run(res, request.Run)
+
+	case request.Attach != nil:
+		res.logger.Debug("handling-attach")
+		mgr.Attach(res, request.Attach)
+
+	case request.CreateDir != nil:
+		res.logger.Debug("handling-create-dir")
+		mgr.CreateDir(res, request.CreateDir)
+
+	case request.SetWindowSize != nil:
+		res.logger.Debug("handling-set-window-size")
+		mgr.SetWindowSize(res, request.SetWindowSize)
+
+	case request.Signal != nil:
+		res.logger.Debug("handling-signal")
+		mgr.Signal(res, request.Signal)
+
+	case request.CloseStdin != nil:
+		res.logger.Debug("handling-close-stdin")
+		mgr.CloseStdin(res, request.CloseStdin)
+
+	case request.Stop != nil:
+		res.logger.Debug("handling-stop")
+		mgr.Stop(res, request.Stop)
+
+	case request.ListProcesses != nil:
+		mgr.ListProcesses(res, request.ListProcesses)
+
+	case request.StreamIn != nil:
+		res.logger.Debug("handling-stream-in")
+		mgr.StreamIn(res, request.StreamIn, fds)
+
+	case request.StreamOut != nil:
+		res.logger.Debug("handling-stream-out")
+		mgr.StreamOut(res, request.StreamOut, fds)
+
+	default:
+		// e.g. a request type added by a newer client, which both codecs silently
+		// drops when decoding
+		respondErr(res, errors.New("unknown request"))
 	}
 }
 
-func respondErr(conn net.Conn, err error) {
+func respondErr(res *responder, err error) {
 	msg := err.Error()
 
-	encodeErr := respondUnix(conn, ginit.Response{Error: &msg}, nil)
+	res.logger.Debug("responding-with-error", lager.Data{"error": msg})
+
+	encodeErr := respondUnix(res, ginit.Response{Error: &msg}, nil)
 	if encodeErr != nil {
-		println("failed to encode error: " + encodeErr.Error())
+		res.logger.Error("failed-to-encode-error", encodeErr, lager.Data{"error": msg})
 	}
 }
 
-func respondUnix(conn net.Conn, response ginit.Response, rights []byte) error {
-	respBuf := new(bytes.Buffer)
+func respondUnix(res *responder, response ginit.Response, fds []int) error {
+	response.ID = res.requestID
 
-	err := gob.NewEncoder(respBuf).Encode(response)
-	if err != nil {
-		return err
-	}
+	return res.frames.WriteMessage(response, fds)
+}
 
-	_, _, err = conn.(*net.UnixConn).WriteMsgUnix(respBuf.Bytes(), rights, nil)
-	if err != nil {
-		return err
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
 	}
-
-	return nil
 }
@@ -0,0 +1,77 @@
+package gardensystemd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// containerMetadata is persisted as metadata.json in each container's depot
+// dir, so that what happened to a container can be told from the depot, and
+// so that a running container can be adopted when the server starts again.
+//
+// It is first written once the container has been created, so a depot dir
+// without it is from a Create that never finished.
+type containerMetadata struct {
+	Handle     string            `json:"handle"`
+	Properties garden.Properties `json:"properties"`
+	Env        []string          `json:"env"`
+	GraceTime  time.Duration     `json:"grace_time"`
+
+	Events []ContainerEvent `json:"events"`
+}
+
+func readMetadata(dir string) (containerMetadata, error) {
+	payload, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return containerMetadata{}, err
+	}
+
+	var metadata containerMetadata
+	err = json.Unmarshal(payload, &metadata)
+	if err != nil {
+		return containerMetadata{}, fmt.Errorf("invalid metadata in %s: %s", dir, err)
+	}
+
+	return metadata, nil
+}
+
+// writeMetadata replaces the container's metadata atomically, so that it is
+// never seen half-written.
+func writeMetadata(dir string, metadata containerMetadata) error {
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "metadata.json.")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(payload)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, "metadata.json"))
+}
@@ -0,0 +1,267 @@
+package gardensystemd
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vito/garden-systemd/ginit"
+)
+
+const metricsNamespace = "garden_systemd"
+
+// Metrics instruments the backend's operations. It is a
+// prometheus.Collector; per-container state and resource usage are
+// collected separately, by NewContainerCollector.
+type Metrics struct {
+	durations  *prometheus.HistogramVec
+	failures   *prometheus.CounterVec
+	dialErrors prometheus.Counter
+	events     *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "operation_duration_seconds",
+				Help:      "How long operations took, whether or not they succeeded.",
+
+				// from 10ms to ~80s; creating a container can take a while
+				Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+			},
+			[]string{"operation"},
+		),
+
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "operation_failures_total",
+				Help:      "Operations that failed, by cause.",
+			},
+			[]string{"operation", "cause"},
+		),
+
+		dialErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "wshd_dial_errors_total",
+				Help:      "Attempts to connect to a container's wshd that failed.",
+			},
+		),
+
+		events: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Name:      "container_events_total",
+				Help:      "Container events recorded, by type.",
+			},
+			[]string{"type"},
+		),
+	}
+}
+
+func (metrics *Metrics) Describe(descs chan<- *prometheus.Desc) {
+	metrics.durations.Describe(descs)
+	metrics.failures.Describe(descs)
+	metrics.dialErrors.Describe(descs)
+	metrics.events.Describe(descs)
+}
+
+func (metrics *Metrics) Collect(ms chan<- prometheus.Metric) {
+	metrics.durations.Collect(ms)
+	metrics.failures.Collect(ms)
+	metrics.dialErrors.Collect(ms)
+	metrics.events.Collect(ms)
+}
+
+// observe records the duration and outcome of an operation.
+func (metrics *Metrics) observe(operation string, started time.Time, err error) {
+	metrics.durations.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+
+	if err != nil {
+		metrics.failures.WithLabelValues(operation, failureCause(err)).Inc()
+	}
+
+	metrics.checkWshd(err)
+}
+
+// checkWshd counts the error if it is from failing to connect to wshd.
+func (metrics *Metrics) checkWshd(err error) {
+	var dialErr ginit.DialError
+	if errors.As(err, &dialErr) {
+		metrics.dialErrors.Inc()
+	}
+}
+
+func (metrics *Metrics) event(eventType string) {
+	metrics.events.WithLabelValues(eventType).Inc()
+}
+
+// causedError attributes an error to the step of an operation that failed,
+// for failure metrics.
+type causedError struct {
+	cause string
+	err   error
+}
+
+func (err causedError) Error() string {
+	return err.err.Error()
+}
+
+func (err causedError) Unwrap() error {
+	return err.err
+}
+
+// failureCause classifies an error as a metric label.
+func failureCause(err error) string {
+	var caused causedError
+	var createErr CreateError
+	var dialErr ginit.DialError
+	var handshakeErr ginit.HandshakeError
+	var requestErr ginit.RequestError
+	var remoteErr ginit.RemoteError
+	var notFoundErr garden.ContainerNotFoundError
+	var duplicateErr DuplicateHandleError
+	var stateErr ContainerStateError
+
+	switch {
+	case errors.As(err, &caused):
+		return caused.cause
+	case errors.As(err, &createErr):
+		return createErr.Step
+	case errors.As(err, &notFoundErr):
+		return "not_found"
+	case errors.As(err, &duplicateErr):
+		return "duplicate_handle"
+	case errors.As(err, &stateErr):
+		return "invalid_state"
+	case errors.As(err, &dialErr):
+		return "wshd_unreachable"
+	case errors.As(err, &handshakeErr):
+		return "wshd_handshake"
+	case errors.As(err, &requestErr):
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "wshd_timeout"
+		}
+
+		return "wshd_request"
+	case errors.As(err, &remoteErr):
+		return "wshd_error"
+	default:
+		return "other"
+	}
+}
+
+// containerCollector reports the state and resource usage of each container
+// at the time of each scrape.
+type containerCollector struct {
+	backend *Backend
+
+	containers  *prometheus.Desc
+	memoryBytes *prometheus.Desc
+	cpuSeconds  *prometheus.Desc
+	pids        *prometheus.Desc
+}
+
+// NewContainerCollector returns a collector for the backend's containers.
+// Resource usage is read from each container's cgroup, and is omitted for
+// containers that don't have their own (e.g. with the chroot runtime).
+func NewContainerCollector(backend *Backend) prometheus.Collector {
+	return &containerCollector{
+		backend: backend,
+
+		containers: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "containers"),
+			"Number of containers, by lifecycle state.",
+			[]string{"state"},
+			nil,
+		),
+
+		memoryBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "memory_bytes"),
+			"Memory used by the container's cgroup.",
+			[]string{"handle"},
+			nil,
+		),
+
+		cpuSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "cpu_seconds_total"),
+			"CPU time consumed by the container's cgroup.",
+			[]string{"handle"},
+			nil,
+		),
+
+		pids: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "container", "pids"),
+			"Number of processes in the container's cgroup.",
+			[]string{"handle"},
+			nil,
+		),
+	}
+}
+
+func (collector *containerCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.containers
+	descs <- collector.memoryBytes
+	descs <- collector.cpuSeconds
+	descs <- collector.pids
+}
+
+func (collector *containerCollector) Collect(ms chan<- prometheus.Metric) {
+	backend := collector.backend
+
+	backend.containersL.RLock()
+	containers := make([]*container, 0, len(backend.containers))
+	for _, container := range backend.containers {
+		containers = append(containers, container)
+	}
+	backend.containersL.RUnlock()
+
+	states := map[containerState]int{}
+	for _, state := range containerStates {
+		states[state] = 0
+	}
+
+	for _, container := range containers {
+		state := container.currentState()
+
+		states[state]++
+
+		if state == containerCreating || state == containerDestroying {
+			continue
+		}
+
+		status, err := backend.runtime.Status(container.id)
+		if err != nil {
+			backend.logger.Error("failed-to-get-status", err, lager.Data{"handle": container.handle})
+			continue
+		}
+
+		if !status.Running {
+			continue
+		}
+
+		stats, found, err := readCgroupStats(status.Pid)
+		if err != nil {
+			backend.logger.Error("failed-to-read-cgroup-stats", err, lager.Data{"handle": container.handle})
+			continue
+		}
+
+		if !found {
+			continue
+		}
+
+		ms <- prometheus.MustNewConstMetric(collector.memoryBytes, prometheus.GaugeValue, float64(stats.MemoryBytes), container.handle)
+		ms <- prometheus.MustNewConstMetric(collector.cpuSeconds, prometheus.CounterValue, stats.CPUTime.Seconds(), container.handle)
+		ms <- prometheus.MustNewConstMetric(collector.pids, prometheus.GaugeValue, float64(stats.Pids), container.handle)
+	}
+
+	for state, count := range states {
+		ms <- prometheus.MustNewConstMetric(collector.containers, prometheus.GaugeValue, float64(count), string(state))
+	}
+}
@@ -0,0 +1,211 @@
+package gardensystemd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/garden"
+	"code.cloudfoundry.org/lager"
+	"github.com/vito/garden-systemd/systemd"
+)
+
+// NspawnRuntime runs each container as an instance of the
+// garden-container@.service unit, which runs systemd-nspawn.
+type NspawnRuntime struct {
+	logger lager.Logger
+
+	manager     systemd.Manager
+	skeletonDir string
+}
+
+func NewNspawnRuntime(logger lager.Logger, manager systemd.Manager, skeletonDir string) *NspawnRuntime {
+	return &NspawnRuntime{
+		logger: logger,
+
+		manager:     manager,
+		skeletonDir: skeletonDir,
+	}
+}
+
+func (runtime *NspawnRuntime) Setup() error {
+	return runtime.manager.LinkUnitFile(filepath.Join(runtime.skeletonDir, "garden-container@.service"))
+}
+
+func (runtime *NspawnRuntime) Start(spec RuntimeSpec) error {
+	nspawnFlags := []string{}
+
+	for _, mount := range spec.BindMounts {
+		switch mount.Mode {
+		case garden.BindMountModeRO:
+			nspawnFlags = append(nspawnFlags, "--bind-ro", mount.SrcPath+":"+mount.DstPath)
+		case garden.BindMountModeRW:
+			nspawnFlags = append(nspawnFlags, "--bind", mount.SrcPath+":"+mount.DstPath)
+		}
+	}
+
+	start := fmt.Sprintf(
+		`#!/bin/sh
+
+exec /usr/bin/systemd-nspawn \
+	--capability all \
+	--machine %[1]s \
+	--directory %[2]s \
+	--ephemeral \
+	--quiet \
+	--keep-unit \
+	--notify-ready=yes \
+	--bind %[5]s \
+	--bind %[6]s \
+	--bind %[7]s \
+	--bind %[8]s \
+	%[3]s \
+	-- /sbin/wshd --run /tmp/garden-init --logs /tmp/garden-logs %[4]s`,
+		shellQuote(spec.ID),
+		shellQuote(spec.RootFSPath),
+		shellQuoteAll(nspawnFlags),
+		shellQuoteAll(spec.WshdFlags),
+		shellQuote(filepath.Join(spec.Dir, "tmp")+":/tmp"),
+		shellQuote(filepath.Join(spec.Dir, "run")+":/tmp/garden-init"),
+		shellQuote(filepath.Join(spec.Dir, "bin", "wshd")+":/sbin/wshd"),
+		shellQuote(filepath.Join(spec.Dir, "logs")+":/tmp/garden-logs"),
+	)
+
+	err := ioutil.WriteFile(filepath.Join(spec.Dir, "start"), []byte(start), 0755)
+	if err != nil {
+		return err
+	}
+
+	unit := containerUnit(spec.ID)
+
+	// the unit is Type=notify and wshd notifies once it is accepting
+	// requests, so this returns as soon as the container can be used
+	err = runtime.manager.StartUnit(unit)
+	if err != nil {
+		startErr := fmt.Errorf("container failed to start: %s\n\n%s", err, runtime.describeUnitFailure(unit))
+
+		if err := runtime.Stop(spec.ID); err != nil {
+			runtime.logger.Error("failed-to-cleanup-container", err, lager.Data{"id": spec.ID})
+		}
+
+		return startErr
+	}
+
+	return nil
+}
+
+func (runtime *NspawnRuntime) Stop(id string) error {
+	err := runtime.manager.StopUnit(containerUnit(id))
+	if _, notFound := err.(systemd.UnitNotFoundError); notFound {
+		return nil
+	}
+
+	return err
+}
+
+func (runtime *NspawnRuntime) Kill(id string, signal syscall.Signal) error {
+	return runtime.manager.KillMachine(id, signal)
+}
+
+func (runtime *NspawnRuntime) CopyIn(id string, src string, dst string) error {
+	return runtime.manager.CopyToMachine(id, src, dst)
+}
+
+func (runtime *NspawnRuntime) CopyOut(id string, src string, dst string) error {
+	return runtime.manager.CopyFromMachine(id, src, dst)
+}
+
+func (runtime *NspawnRuntime) Status(id string) (RuntimeStatus, error) {
+	machine, err := runtime.manager.GetMachine(id)
+	if _, notFound := err.(systemd.MachineNotFoundError); notFound {
+		return RuntimeStatus{
+			Reason: runtime.stopReason(id),
+		}, nil
+	}
+
+	if err != nil {
+		return RuntimeStatus{}, err
+	}
+
+	if machine.State != "running" {
+		return RuntimeStatus{
+			Reason: runtime.stopReason(id),
+		}, nil
+	}
+
+	return RuntimeStatus{
+		Running: true,
+		Pid:     int(machine.Leader),
+	}, nil
+}
+
+// stopReason describes why a container's unit is not running, e.g. "unit
+// failed (oom-kill)".
+func (runtime *NspawnRuntime) stopReason(id string) string {
+	status, err := runtime.manager.UnitStatus(containerUnit(id))
+	if err != nil {
+		return ""
+	}
+
+	reason := "unit " + status.ActiveState
+	if status.Result != "" && status.Result != "success" {
+		reason += " (" + status.Result + ")"
+	}
+
+	return reason
+}
+
+func (runtime *NspawnRuntime) List() ([]string, error) {
+	units, err := runtime.manager.ListUnits(containerUnit("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, unit := range units {
+		if unit.ActiveState == "inactive" {
+			continue
+		}
+
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(unit.Name, "garden-container@"), ".service"))
+	}
+
+	return ids, nil
+}
+
+func shellQuoteAll(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func containerUnit(id string) string {
+	return "garden-container@" + id + ".service"
+}
+
+// describeUnitFailure collects the status and most recent logs of a unit, to
+// explain why it failed.
+func (runtime *NspawnRuntime) describeUnitFailure(unit string) string {
+	var status string
+
+	unitStatus, err := runtime.manager.UnitStatus(unit)
+	if err != nil {
+		status = "unavailable: " + err.Error()
+	} else {
+		status = fmt.Sprintf("%s (%s), result: %s", unitStatus.ActiveState, unitStatus.SubState, unitStatus.Result)
+	}
+
+	// the journal isn't exposed over D-Bus
+	logs, err := exec.Command("journalctl", "--no-pager", "--lines=20", "--unit", unit).CombinedOutput()
+	if err != nil && len(logs) == 0 {
+		logs = []byte("unavailable: " + err.Error())
+	}
+
+	return fmt.Sprintf("status: %s\n\nlogs:\n%s", status, logs)
+}
@@ -1,10 +1,9 @@
 package gardensystemd
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"sync"
 	"syscall"
@@ -19,48 +18,29 @@ type initProcess struct {
 	copying *sync.WaitGroup
 	statusR *os.File
 
-	wshdSock string
+	wshd *ginit.Client
 }
 
 func attachProcess(
 	processID string,
 	processIO garden.ProcessIO,
-	rights ginit.FDRights,
-	fds []int,
-	wshdSock string,
+	files ginit.ProcessFiles,
+	wshd *ginit.Client,
 ) *initProcess {
-	offsets := rights.Offsets()
-
-	var status, stdin, stdout, stderr *os.File
-
-	if offsets.Status != nil {
-		status = os.NewFile(uintptr(fds[*offsets.Status]), "status")
-	}
-
-	if offsets.Stdin != nil {
-		stdin = os.NewFile(uintptr(fds[*offsets.Stdin]), "stdin")
-	}
-
-	if offsets.Stdout != nil {
-		stdout = os.NewFile(uintptr(fds[*offsets.Stdout]), "stdout")
-	}
-
-	if offsets.Stderr != nil {
-		stderr = os.NewFile(uintptr(fds[*offsets.Stderr]), "stderr")
-	}
-
 	copying := new(sync.WaitGroup)
 
 	process := &initProcess{
 		processID: processID,
 
 		copying: copying,
-		statusR: status,
+		statusR: files.Status,
 
-		wshdSock: wshdSock,
+		wshd: wshd,
 	}
 
-	if stdin != nil {
+	if files.Stdin != nil {
+		stdin := files.Stdin
+
 		// does not count towards copying; there may never be anything on
 		// processIO.Stdin, which would block forever.
 		go func() {
@@ -73,7 +53,9 @@ func attachProcess(
 		}()
 	}
 
-	if stdout != nil {
+	if files.Stdout != nil {
+		stdout := files.Stdout
+
 		copying.Add(1)
 		go func() {
 			io.Copy(processIO.Stdout, stdout)
@@ -82,7 +64,9 @@ func attachProcess(
 		}()
 	}
 
-	if stderr != nil {
+	if files.Stderr != nil {
+		stderr := files.Stderr
+
 		copying.Add(1)
 		go func() {
 			io.Copy(processIO.Stderr, stderr)
@@ -111,52 +95,20 @@ func (p *initProcess) Wait() (int, error) {
 }
 
 func (p *initProcess) SetTTY(spec garden.TTYSpec) error {
-	conn, err := net.Dial("unix", p.wshdSock)
-	if err != nil {
-		println("dial wshd: " + err.Error())
-		return err
-	}
-
-	defer conn.Close()
-
-	enc := gob.NewEncoder(conn)
-
 	var columns, rows int
 	if spec.WindowSize != nil {
 		columns = spec.WindowSize.Columns
 		rows = spec.WindowSize.Rows
 	}
 
-	err = enc.Encode(ginit.Request{
-		SetWindowSize: &ginit.SetWindowSizeRequest{
-			ProcessID: p.processID,
-			Columns:   columns,
-			Rows:      rows,
-		},
-	})
-	if err != nil {
-		println("run request: " + err.Error())
-		return err
-	}
-
-	var response ginit.Response
-	err = gob.NewDecoder(conn).Decode(&response)
-	if err != nil {
-		println("decode response: " + err.Error())
-		return err
-	}
-
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
 
-	return nil
+	return p.wshd.SetWindowSize(ctx, p.processID, columns, rows)
 }
 
 func (p *initProcess) Signal(sig garden.Signal) error {
-	var signal os.Signal
+	var signal syscall.Signal
 	switch sig {
 	case garden.SignalTerminate:
 		signal = syscall.SIGTERM
@@ -164,76 +116,15 @@ func (p *initProcess) Signal(sig garden.Signal) error {
 		signal = syscall.SIGKILL
 	}
 
-	conn, err := net.Dial("unix", p.wshdSock)
-	if err != nil {
-		println("dial wshd: " + err.Error())
-		return err
-	}
-
-	defer conn.Close()
-
-	enc := gob.NewEncoder(conn)
-
-	err = enc.Encode(ginit.Request{
-		Signal: &ginit.SignalRequest{
-			ProcessID: p.processID,
-			Signal:    signal,
-		},
-	})
-	if err != nil {
-		println("run request: " + err.Error())
-		return err
-	}
-
-	var response ginit.Response
-	err = gob.NewDecoder(conn).Decode(&response)
-	if err != nil {
-		println("decode response: " + err.Error())
-		return err
-	}
-
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
 
-	return nil
+	return p.wshd.Signal(ctx, p.processID, signal)
 }
 
 func (p *initProcess) closeStdin() error {
-	conn, err := net.Dial("unix", p.wshdSock)
-	if err != nil {
-		println("dial wshd: " + err.Error())
-		return err
-	}
-
-	defer conn.Close()
-
-	enc := gob.NewEncoder(conn)
-
-	err = enc.Encode(ginit.Request{
-		CloseStdin: &ginit.CloseStdinRequest{
-			ProcessID: p.processID,
-		},
-	})
-	if err != nil {
-		println("run request: " + err.Error())
-		return err
-	}
-
-	var response ginit.Response
-	err = gob.NewDecoder(conn).Decode(&response)
-	if err != nil {
-		println("decode response: " + err.Error())
-		return err
-	}
-
-	if response.Error != nil {
-		err := fmt.Errorf("remote error: %s", *response.Error)
-		println(err.Error())
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), wshdRequestTimeout)
+	defer cancel()
 
-	return nil
+	return p.wshd.CloseStdin(ctx, p.processID)
 }
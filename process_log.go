@@ -0,0 +1,136 @@
+package gardensystemd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/garden"
+)
+
+type ProcessLogStream string
+
+const (
+	ProcessLogStdout ProcessLogStream = "stdout"
+	ProcessLogStderr ProcessLogStream = "stderr"
+)
+
+// ProcessLog returns a process's persisted output, oldest first, spanning
+// any rotated log files.
+func (container *container) ProcessLog(processID string, stream ProcessLogStream) (io.ReadCloser, error) {
+	if stream != ProcessLogStdout && stream != ProcessLogStderr {
+		return nil, fmt.Errorf("unknown log stream: %s", stream)
+	}
+
+	if processID == "" || strings.ContainsAny(processID, "/\x00") || processID == "." || processID == ".." {
+		return nil, garden.ProcessNotFoundError{ProcessID: processID}
+	}
+
+	logPath := filepath.Join(container.dir, "logs", processID, string(stream)+".log")
+
+	if _, err := os.Stat(filepath.Dir(logPath)); os.IsNotExist(err) {
+		return nil, garden.ProcessNotFoundError{ProcessID: processID}
+	}
+
+	rotated, err := filepath.Glob(logPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// rotated files are numbered newest-first, so read them in reverse
+	paths := []string{}
+	for i := len(rotated); i > 0; i-- {
+		path := fmt.Sprintf("%s.%d", logPath, i)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	paths = append(paths, logPath)
+
+	files := []*os.File{}
+	readers := []io.Reader{}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// e.g. no stderr for a tty, or rotated away while we were listing
+			continue
+		}
+
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+
+			return nil, err
+		}
+
+		files = append(files, file)
+		readers = append(readers, file)
+	}
+
+	return &processLogReader{
+		Reader: io.MultiReader(readers...),
+		files:  files,
+	}, nil
+}
+
+type processLogReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *processLogReader) Close() error {
+	var firstErr error
+
+	for _, f := range r.files {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// NewProcessLogHandler serves the persisted output of processes, given the
+// handle, process and stream (stdout or stderr, by default stdout) query
+// parameters.
+func NewProcessLogHandler(backend *Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		stream := ProcessLogStream(query.Get("stream"))
+		if stream == "" {
+			stream = ProcessLogStdout
+		}
+
+		if stream != ProcessLogStdout && stream != ProcessLogStderr {
+			http.Error(w, fmt.Sprintf("unknown log stream: %s", stream), http.StatusBadRequest)
+			return
+		}
+
+		log, err := backend.ProcessLog(query.Get("handle"), query.Get("process"), stream)
+		if err != nil {
+			switch err.(type) {
+			case garden.ContainerNotFoundError, garden.ProcessNotFoundError:
+				http.Error(w, err.Error(), http.StatusNotFound)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		defer log.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		io.Copy(w, log)
+	})
+}
@@ -0,0 +1,41 @@
+package ptyutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ErrNotCanonical is returned by SendEOF when the terminal isn't in
+// canonical mode, in which its EOF character would be read as a literal ^D.
+var ErrNotCanonical = errors.New("terminal is not in canonical mode")
+
+// SendEOF writes the terminal's EOF character (usually ^D) to a pty master,
+// ending the input of whatever is reading the slave side without tearing
+// down the terminal itself.
+//
+// EOF only ends input at the start of a line; after a partial line it just
+// hands the line to the reader, which sees end of input at the next EOF.
+func SendEOF(f *os.File) error {
+	var attr syscall.Termios
+
+	_, _, e := syscall.Syscall6(
+		syscall.SYS_IOCTL,
+		uintptr(f.Fd()),
+		uintptr(syscall.TCGETS),
+		uintptr(unsafe.Pointer(&attr)),
+		0, 0, 0,
+	)
+
+	if e != 0 {
+		return e
+	}
+
+	if attr.Lflag&syscall.ICANON == 0 {
+		return ErrNotCanonical
+	}
+
+	_, err := f.Write([]byte{attr.Cc[syscall.VEOF]})
+	return err
+}
@@ -19,3 +19,26 @@ func SetRaw(tty *os.File) error {
 
 	return termios.Tcsetattr(uintptr(tty.Fd()), termios.TCSANOW, (*syscall.Termios)(&attr))
 }
+
+// State is a terminal's attributes, saved so they can be restored after
+// SetRaw.
+type State struct {
+	attr syscall.Termios
+}
+
+func GetState(tty *os.File) (*State, error) {
+	var attr syscall.Termios
+
+	err := termios.Tcgetattr(uintptr(tty.Fd()), (*syscall.Termios)(&attr))
+	if err != nil {
+		return nil, err
+	}
+
+	return &State{attr: attr}, nil
+}
+
+func Restore(tty *os.File, state *State) error {
+	attr := state.attr
+
+	return termios.Tcsetattr(uintptr(tty.Fd()), termios.TCSANOW, (*syscall.Termios)(&attr))
+}
@@ -28,3 +28,21 @@ func SetWinSize(f *os.File, cols int, rows int) error {
 
 	return nil
 }
+
+func GetWinSize(f *os.File) (int, int, error) {
+	var size ttySize
+
+	_, _, e := syscall.Syscall6(
+		syscall.SYS_IOCTL,
+		uintptr(f.Fd()),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&size)),
+		0, 0, 0,
+	)
+
+	if e != 0 {
+		return 0, 0, syscall.ENOTTY
+	}
+
+	return int(size.Cols), int(size.Rows), nil
+}
@@ -0,0 +1,64 @@
+package gardensystemd
+
+import (
+	"syscall"
+
+	"code.cloudfoundry.org/garden"
+)
+
+// Runtime runs a container's wshd. By the time Start is called, the
+// container's depot dir has been populated with run/, tmp/, logs/ and
+// bin/wshd, and its rootfs has a /sbin/wshd to mount over.
+type Runtime interface {
+	// Setup is called once, when the backend starts.
+	Setup() error
+
+	// Start returns once wshd is accepting requests. If it fails (including
+	// by timing out), it leaves nothing running.
+	Start(spec RuntimeSpec) error
+
+	// Stop stops the container and waits for it to exit. Stopping a
+	// container that is not running is not an error.
+	Stop(id string) error
+
+	// Kill sends a signal to every process in the container.
+	Kill(id string, signal syscall.Signal) error
+
+	// CopyIn copies the contents of a host dir into a dir in the container,
+	// and CopyOut copies a path in the container to the host. Streaming
+	// goes through wshd instead, unless it is too old to support it.
+	CopyIn(id string, src string, dst string) error
+	CopyOut(id string, src string, dst string) error
+
+	Status(id string) (RuntimeStatus, error)
+
+	// List returns the IDs of the containers the runtime knows about,
+	// including any left behind by a previous run of the server, if the
+	// runtime can find them.
+	List() ([]string, error)
+}
+
+type RuntimeSpec struct {
+	ID string
+
+	// the container's depot dir
+	Dir string
+
+	// host path to the rootfs
+	RootFSPath string
+
+	BindMounts []garden.BindMount
+
+	// extra flags to pass to wshd
+	WshdFlags []string
+}
+
+type RuntimeStatus struct {
+	Running bool
+
+	// host PID of the container's init, if running
+	Pid int
+
+	// why the container is not running, if known
+	Reason string
+}
@@ -0,0 +1,172 @@
+package gardensystemd
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// containerState is where a container is in its lifecycle. It is only
+// changed under the container's stateL.
+type containerState string
+
+const (
+	// Create is in progress; the handle is reserved but not yet usable
+	containerCreating containerState = "creating"
+
+	// created, and not stopped or being destroyed
+	containerActive containerState = "active"
+
+	// Stop is in progress
+	containerStopping containerState = "stopping"
+
+	// its processes were stopped, or it stopped by itself
+	containerStopped containerState = "stopped"
+
+	// Destroy is in progress
+	containerDestroying containerState = "destroying"
+)
+
+var containerStates = []containerState{
+	containerCreating,
+	containerActive,
+	containerStopping,
+	containerStopped,
+	containerDestroying,
+}
+
+// DuplicateHandleError is returned by Create when a container with the
+// requested handle already exists, or is being created.
+type DuplicateHandleError struct {
+	Handle string
+}
+
+func (err DuplicateHandleError) Error() string {
+	return fmt.Sprintf("handle already exists: %s", err.Handle)
+}
+
+// ContainerStateError is returned when an operation can't be performed in
+// the container's current state, e.g. running a process in a container that
+// is being destroyed.
+type ContainerStateError struct {
+	Handle    string
+	Operation string
+	State     string
+}
+
+func (err ContainerStateError) Error() string {
+	return fmt.Sprintf("cannot %s container %s: container is %s", err.Operation, err.Handle, err.State)
+}
+
+// transition moves the container to the given state if it is in one of the
+// states it may be moved from, returning the state it was in.
+func (container *container) transition(operation string, to containerState, from ...containerState) (containerState, error) {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	current := container.state
+
+	for _, state := range from {
+		if state == current {
+			container.state = to
+
+			if to != current {
+				container.logger.Debug("state-changed", lager.Data{
+					"from": string(current),
+					"to":   string(to),
+				})
+			}
+
+			return current, nil
+		}
+	}
+
+	return current, ContainerStateError{
+		Handle:    container.handle,
+		Operation: operation,
+		State:     string(current),
+	}
+}
+
+// checkState returns an error if the container can't be used for the given
+// operation, i.e. because it is still being created or is being destroyed.
+func (container *container) checkState(operation string) error {
+	state := container.currentState()
+
+	switch state {
+	case containerCreating, containerDestroying:
+		return ContainerStateError{
+			Handle:    container.handle,
+			Operation: operation,
+			State:     string(state),
+		}
+	}
+
+	return nil
+}
+
+// beginDestroy moves the container to destroying, unless it is still being
+// created. If it is already being destroyed, it instead returns a channel
+// that is closed once that has finished, so that Destroy can be called any
+// number of times at once.
+func (container *container) beginDestroy() (<-chan struct{}, error) {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	switch container.state {
+	case containerCreating:
+		return nil, ContainerStateError{
+			Handle:    container.handle,
+			Operation: "destroy",
+			State:     string(container.state),
+		}
+
+	case containerDestroying:
+		return container.destroyed, nil
+	}
+
+	container.logger.Debug("state-changed", lager.Data{
+		"from": string(container.state),
+		"to":   string(containerDestroying),
+	})
+
+	container.state = containerDestroying
+	container.destroyed = make(chan struct{})
+	container.destroyErr = nil
+
+	return nil, nil
+}
+
+// finishDestroy records the outcome of destroying the container for any
+// concurrent Destroys waiting on it. If destroying failed, the container is
+// left stopped, so that Destroy can be retried.
+func (container *container) finishDestroy(err error) {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	if err != nil {
+		container.logger.Debug("state-changed", lager.Data{
+			"from": string(containerDestroying),
+			"to":   string(containerStopped),
+		})
+
+		container.state = containerStopped
+	}
+
+	container.destroyErr = err
+	close(container.destroyed)
+}
+
+func (container *container) destroyResult() error {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	return container.destroyErr
+}
+
+func (container *container) currentState() containerState {
+	container.stateL.Lock()
+	defer container.stateL.Unlock()
+
+	return container.state
+}
@@ -0,0 +1,161 @@
+package gardensystemd
+
+import (
+	"errors"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func containerIn(state containerState) *container {
+	return &container{
+		logger: lager.NewLogger("test"),
+		handle: "some-handle",
+		state:  state,
+	}
+}
+
+func TestTransition(t *testing.T) {
+	for _, example := range []struct {
+		state   containerState
+		to      containerState
+		from    []containerState
+		allowed bool
+	}{
+		{containerCreating, containerActive, []containerState{containerCreating}, true},
+		{containerActive, containerStopping, []containerState{containerActive, containerStopped}, true},
+		{containerStopped, containerStopping, []containerState{containerActive, containerStopped}, true},
+		{containerStopping, containerStopping, []containerState{containerActive, containerStopped}, false},
+		{containerDestroying, containerStopping, []containerState{containerActive, containerStopped}, false},
+		{containerCreating, containerStopping, []containerState{containerActive, containerStopped}, false},
+	} {
+		container := containerIn(example.state)
+
+		previous, err := container.transition("some-operation", example.to, example.from...)
+		if previous != example.state {
+			t.Errorf("%s -> %s: expected the previous state to be returned, got %s", example.state, example.to, previous)
+		}
+
+		if !example.allowed {
+			expected := ContainerStateError{
+				Handle:    "some-handle",
+				Operation: "some-operation",
+				State:     string(example.state),
+			}
+
+			if err != expected {
+				t.Errorf("%s -> %s: expected %#v, got %#v", example.state, example.to, expected, err)
+			}
+
+			if container.currentState() != example.state {
+				t.Errorf("%s -> %s: expected the state to be left alone, got %s", example.state, example.to, container.currentState())
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s -> %s: %s", example.state, example.to, err)
+		}
+
+		if container.currentState() != example.to {
+			t.Errorf("%s -> %s: got %s", example.state, example.to, container.currentState())
+		}
+	}
+}
+
+func TestCheckState(t *testing.T) {
+	for _, state := range containerStates {
+		err := containerIn(state).checkState("run")
+
+		usable := state != containerCreating && state != containerDestroying
+		if usable && err != nil {
+			t.Errorf("%s: expected to be usable, got %s", state, err)
+		}
+
+		if !usable && err == nil {
+			t.Errorf("%s: expected an error", state)
+		}
+	}
+}
+
+func TestBeginDestroyRefusesContainersBeingCreated(t *testing.T) {
+	container := containerIn(containerCreating)
+
+	_, err := container.beginDestroy()
+	if _, ok := err.(ContainerStateError); !ok {
+		t.Errorf("expected a ContainerStateError, got %#v", err)
+	}
+
+	if container.currentState() != containerCreating {
+		t.Errorf("expected the state to be left alone, got %s", container.currentState())
+	}
+}
+
+func TestConcurrentDestroysWaitForTheFirst(t *testing.T) {
+	container := containerIn(containerActive)
+
+	wait, err := container.beginDestroy()
+	if err != nil || wait != nil {
+		t.Fatalf("expected the first destroy to proceed, got %v, %v", wait, err)
+	}
+
+	if container.currentState() != containerDestroying {
+		t.Errorf("expected the container to be destroying, got %s", container.currentState())
+	}
+
+	wait, err = container.beginDestroy()
+	if err != nil || wait == nil {
+		t.Fatalf("expected a second destroy to wait, got %v, %v", wait, err)
+	}
+
+	select {
+	case <-wait:
+		t.Fatal("expected to wait until the first destroy has finished")
+	default:
+	}
+
+	container.finishDestroy(nil)
+
+	<-wait
+
+	if container.destroyResult() != nil {
+		t.Errorf("expected the destroy to succeed, got %s", container.destroyResult())
+	}
+}
+
+func TestFailedDestroysCanBeRetried(t *testing.T) {
+	container := containerIn(containerActive)
+
+	_, err := container.beginDestroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait, err := container.beginDestroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destroyErr := errors.New("destroy failed")
+	container.finishDestroy(destroyErr)
+
+	<-wait
+
+	if container.destroyResult() != destroyErr {
+		t.Errorf("expected the waiting destroy to see %s, got %v", destroyErr, container.destroyResult())
+	}
+
+	if container.currentState() != containerStopped {
+		t.Errorf("expected the container to be left stopped, got %s", container.currentState())
+	}
+
+	wait, err = container.beginDestroy()
+	if err != nil || wait != nil {
+		t.Fatalf("expected destroy to be retried, got %v, %v", wait, err)
+	}
+
+	if container.destroyResult() != nil {
+		t.Errorf("expected the previous failure to be cleared, got %s", container.destroyResult())
+	}
+}
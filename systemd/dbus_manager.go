@@ -0,0 +1,209 @@
+package systemd
+
+import (
+	"context"
+	"syscall"
+
+	sddbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	machinedDest      = "org.freedesktop.machine1"
+	machinedPath      = "/org/freedesktop/machine1"
+	machinedInterface = "org.freedesktop.machine1.Manager"
+	machineInterface  = "org.freedesktop.machine1.Machine"
+
+	noSuchUnitError    = "org.freedesktop.systemd1.NoSuchUnit"
+	noSuchMachineError = "org.freedesktop.machine1.NoSuchMachine"
+)
+
+type dbusManager struct {
+	systemd *sddbus.Conn
+	bus     *dbus.Conn
+}
+
+// NewDBusManager connects to the system bus.
+func NewDBusManager() (Manager, error) {
+	systemd, err := sddbus.NewSystemConnectionContext(context.Background())
+	if err != nil {
+		return nil, CallError{Method: "connect to systemd", Err: err}
+	}
+
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		systemd.Close()
+		return nil, CallError{Method: "connect to system bus", Err: err}
+	}
+
+	return &dbusManager{
+		systemd: systemd,
+		bus:     bus,
+	}, nil
+}
+
+func (mgr *dbusManager) LinkUnitFile(path string) error {
+	_, err := mgr.systemd.LinkUnitFilesContext(context.Background(), []string{path}, false, true)
+	if err != nil {
+		return CallError{Method: "LinkUnitFiles", Err: err}
+	}
+
+	err = mgr.systemd.ReloadContext(context.Background())
+	if err != nil {
+		return CallError{Method: "Reload", Err: err}
+	}
+
+	return nil
+}
+
+func (mgr *dbusManager) StartUnit(name string) error {
+	result := make(chan string, 1)
+
+	_, err := mgr.systemd.StartUnitContext(context.Background(), name, "replace", result)
+	if err != nil {
+		return unitError("StartUnit", name, err)
+	}
+
+	return jobResult(name, "start", <-result)
+}
+
+func (mgr *dbusManager) StopUnit(name string) error {
+	result := make(chan string, 1)
+
+	_, err := mgr.systemd.StopUnitContext(context.Background(), name, "replace", result)
+	if err != nil {
+		return unitError("StopUnit", name, err)
+	}
+
+	return jobResult(name, "stop", <-result)
+}
+
+func (mgr *dbusManager) UnitStatus(name string) (UnitStatus, error) {
+	props, err := mgr.systemd.GetUnitPropertiesContext(context.Background(), name)
+	if err != nil {
+		return UnitStatus{}, unitError("GetUnitProperties", name, err)
+	}
+
+	// systemd reports any unit name as loaded, even if it doesn't exist
+	if props["LoadState"] == "not-found" {
+		return UnitStatus{}, UnitNotFoundError{Unit: name}
+	}
+
+	status := UnitStatus{Name: name}
+	status.ActiveState, _ = props["ActiveState"].(string)
+	status.SubState, _ = props["SubState"].(string)
+
+	serviceProps, err := mgr.systemd.GetUnitTypePropertiesContext(context.Background(), name, "Service")
+	if err == nil {
+		status.Result, _ = serviceProps["Result"].(string)
+		status.MainPID, _ = serviceProps["MainPID"].(uint32)
+	}
+
+	return status, nil
+}
+
+func (mgr *dbusManager) ListUnits(pattern string) ([]UnitStatus, error) {
+	units, err := mgr.systemd.ListUnitsByPatternsContext(context.Background(), nil, []string{pattern})
+	if err != nil {
+		return nil, CallError{Method: "ListUnitsByPatterns", Err: err}
+	}
+
+	statuses := []UnitStatus{}
+	for _, unit := range units {
+		statuses = append(statuses, UnitStatus{
+			Name:        unit.Name,
+			ActiveState: unit.ActiveState,
+			SubState:    unit.SubState,
+		})
+	}
+
+	return statuses, nil
+}
+
+func (mgr *dbusManager) GetMachine(name string) (Machine, error) {
+	var path dbus.ObjectPath
+
+	err := mgr.machined().Call(machinedInterface+".GetMachine", 0, name).Store(&path)
+	if err != nil {
+		return Machine{}, machineError("GetMachine", name, err)
+	}
+
+	var props map[string]dbus.Variant
+
+	err = mgr.bus.Object(machinedDest, path).Call("org.freedesktop.DBus.Properties.GetAll", 0, machineInterface).Store(&props)
+	if err != nil {
+		return Machine{}, machineError("GetAll", name, err)
+	}
+
+	machine := Machine{Name: name}
+	machine.Class, _ = props["Class"].Value().(string)
+	machine.Unit, _ = props["Unit"].Value().(string)
+	machine.State, _ = props["State"].Value().(string)
+	machine.Leader, _ = props["Leader"].Value().(uint32)
+	machine.RootDirectory, _ = props["RootDirectory"].Value().(string)
+
+	return machine, nil
+}
+
+func (mgr *dbusManager) KillMachine(name string, signal syscall.Signal) error {
+	err := mgr.machined().Call(machinedInterface+".KillMachine", 0, name, "all", int32(signal)).Err
+	if err != nil {
+		return machineError("KillMachine", name, err)
+	}
+
+	return nil
+}
+
+func (mgr *dbusManager) CopyToMachine(name string, src string, dst string) error {
+	err := mgr.machined().Call(machinedInterface+".CopyToMachine", 0, name, src, dst).Err
+	if err != nil {
+		return machineError("CopyToMachine", name, err)
+	}
+
+	return nil
+}
+
+func (mgr *dbusManager) CopyFromMachine(name string, src string, dst string) error {
+	err := mgr.machined().Call(machinedInterface+".CopyFromMachine", 0, name, src, dst).Err
+	if err != nil {
+		return machineError("CopyFromMachine", name, err)
+	}
+
+	return nil
+}
+
+func (mgr *dbusManager) Close() {
+	mgr.systemd.Close()
+}
+
+func (mgr *dbusManager) machined() dbus.BusObject {
+	return mgr.bus.Object(machinedDest, machinedPath)
+}
+
+func jobResult(unit string, job string, result string) error {
+	if result != "done" {
+		return JobFailedError{
+			Unit:   unit,
+			Job:    job,
+			Result: result,
+		}
+	}
+
+	return nil
+}
+
+func unitError(method string, unit string, err error) error {
+	if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == noSuchUnitError {
+		return UnitNotFoundError{Unit: unit}
+	}
+
+	return CallError{Method: method, Err: err}
+}
+
+func machineError(method string, machine string, err error) error {
+	if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == noSuchMachineError {
+		return MachineNotFoundError{Machine: machine}
+	}
+
+	return CallError{Method: method, Err: err}
+}
@@ -0,0 +1,211 @@
+package systemd
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FakeManager is an in-memory Manager for exercising code that drives
+// systemd on machines that don't have it.
+//
+// Starting a unit named prefix@instance also registers a machine named after
+// the instance, as systemd-nspawn would.
+type FakeManager struct {
+	// if set, called instead of succeeding when a unit is started
+	StartUnitStub func(name string) error
+
+	LinkedUnitFiles []string
+	Units           map[string]UnitStatus
+	Machines        map[string]Machine
+	Kills           []FakeKill
+	Copies          []FakeCopy
+
+	lock sync.Mutex
+}
+
+type FakeKill struct {
+	Machine string
+	Signal  syscall.Signal
+}
+
+type FakeCopy struct {
+	Machine   string
+	ToMachine bool
+	Src       string
+	Dst       string
+}
+
+func NewFakeManager() *FakeManager {
+	return &FakeManager{
+		Units:    map[string]UnitStatus{},
+		Machines: map[string]Machine{},
+	}
+}
+
+func (mgr *FakeManager) LinkUnitFile(path string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	mgr.LinkedUnitFiles = append(mgr.LinkedUnitFiles, path)
+
+	return nil
+}
+
+func (mgr *FakeManager) StartUnit(name string) error {
+	mgr.lock.Lock()
+	stub := mgr.StartUnitStub
+	mgr.lock.Unlock()
+
+	if stub != nil {
+		err := stub(name)
+		if err != nil {
+			mgr.lock.Lock()
+			mgr.Units[name] = UnitStatus{
+				Name:        name,
+				ActiveState: "failed",
+				SubState:    "failed",
+				Result:      "exit-code",
+			}
+			mgr.lock.Unlock()
+
+			return err
+		}
+	}
+
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	mgr.Units[name] = UnitStatus{
+		Name:        name,
+		ActiveState: "active",
+		SubState:    "running",
+		Result:      "success",
+	}
+
+	if at := strings.Index(name, "@"); at != -1 {
+		machine := strings.TrimSuffix(name[at+1:], ".service")
+
+		mgr.Machines[machine] = Machine{
+			Name:  machine,
+			Class: "container",
+			Unit:  name,
+			State: "running",
+		}
+	}
+
+	return nil
+}
+
+func (mgr *FakeManager) StopUnit(name string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	_, found := mgr.Units[name]
+	if !found {
+		return UnitNotFoundError{Unit: name}
+	}
+
+	delete(mgr.Units, name)
+
+	for machineName, machine := range mgr.Machines {
+		if machine.Unit == name {
+			delete(mgr.Machines, machineName)
+		}
+	}
+
+	return nil
+}
+
+func (mgr *FakeManager) UnitStatus(name string) (UnitStatus, error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	status, found := mgr.Units[name]
+	if !found {
+		return UnitStatus{}, UnitNotFoundError{Unit: name}
+	}
+
+	return status, nil
+}
+
+func (mgr *FakeManager) ListUnits(pattern string) ([]UnitStatus, error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	statuses := []UnitStatus{}
+	for name, status := range mgr.Units {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses, nil
+}
+
+func (mgr *FakeManager) GetMachine(name string) (Machine, error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	machine, found := mgr.Machines[name]
+	if !found {
+		return Machine{}, MachineNotFoundError{Machine: name}
+	}
+
+	return machine, nil
+}
+
+func (mgr *FakeManager) KillMachine(name string, signal syscall.Signal) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	if _, found := mgr.Machines[name]; !found {
+		return MachineNotFoundError{Machine: name}
+	}
+
+	mgr.Kills = append(mgr.Kills, FakeKill{
+		Machine: name,
+		Signal:  signal,
+	})
+
+	return nil
+}
+
+func (mgr *FakeManager) CopyToMachine(name string, src string, dst string) error {
+	return mgr.recordCopy(name, true, src, dst)
+}
+
+func (mgr *FakeManager) CopyFromMachine(name string, src string, dst string) error {
+	return mgr.recordCopy(name, false, src, dst)
+}
+
+func (mgr *FakeManager) Close() {}
+
+func (mgr *FakeManager) recordCopy(name string, toMachine bool, src string, dst string) error {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	if _, found := mgr.Machines[name]; !found {
+		return MachineNotFoundError{Machine: name}
+	}
+
+	mgr.Copies = append(mgr.Copies, FakeCopy{
+		Machine:   name,
+		ToMachine: toMachine,
+		Src:       src,
+		Dst:       dst,
+	})
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package systemd
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Manager controls units through systemd and machines through
+// systemd-machined.
+type Manager interface {
+	LinkUnitFile(path string) error
+
+	// StartUnit and StopUnit wait for the queued job to finish, returning a
+	// JobFailedError if it did not succeed.
+	StartUnit(name string) error
+	StopUnit(name string) error
+
+	UnitStatus(name string) (UnitStatus, error)
+
+	// ListUnits returns the loaded units whose names match the glob pattern.
+	ListUnits(pattern string) ([]UnitStatus, error)
+
+	GetMachine(name string) (Machine, error)
+	KillMachine(name string, signal syscall.Signal) error
+	CopyToMachine(name string, src string, dst string) error
+	CopyFromMachine(name string, src string, dst string) error
+
+	Close()
+}
+
+type UnitStatus struct {
+	Name        string
+	ActiveState string // e.g. "active", "failed"
+	SubState    string // e.g. "running", "dead"
+	Result      string // e.g. "success", "exit-code"
+	MainPID     uint32
+}
+
+type Machine struct {
+	Name          string
+	Class         string
+	Unit          string
+	State         string
+	Leader        uint32
+	RootDirectory string
+}
+
+type UnitNotFoundError struct {
+	Unit string
+}
+
+func (err UnitNotFoundError) Error() string {
+	return fmt.Sprintf("unit not found: %s", err.Unit)
+}
+
+type MachineNotFoundError struct {
+	Machine string
+}
+
+func (err MachineNotFoundError) Error() string {
+	return fmt.Sprintf("machine not found: %s", err.Machine)
+}
+
+type JobFailedError struct {
+	Unit   string
+	Job    string // "start" or "stop"
+	Result string // e.g. "failed", "timeout", "dependency"
+}
+
+func (err JobFailedError) Error() string {
+	return fmt.Sprintf("%s job for %s finished with result: %s", err.Job, err.Unit, err.Result)
+}
+
+// CallError is returned for any other failed D-Bus call.
+type CallError struct {
+	Method string
+	Err    error
+}
+
+func (err CallError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Method, err.Err)
+}